@@ -21,7 +21,7 @@ func main() {
 	t2 := benchmark(func() {
 		b := core.NewBlock(nil)
 		b.GenerateMerkelRoot()
-		b.GenerateNonce(core.BLOCK_POW)
+		b.GenerateNonce()
 		b.Sign(core.GenerateNewKeypair())
 	})
 	fmt.Println("Block took", t2)
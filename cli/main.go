@@ -2,14 +2,31 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/izqui/blockchain/core"
 )
 
 var address = flag.String("ip", fmt.Sprintf("%s:%s", core.GetIpAddress()[0], core.BLOCKCHAIN_PORT), "Public facing ip address")
+var rpcAddress = flag.String("rpc", core.RPC_ADDRESS, "JSON-RPC listen address, empty to disable")
+var rpcToken = flag.String("rpctoken", os.Getenv("BLOCKCHAIN_RPC_TOKEN"), "Token RPC clients need to sign with the node key, empty to never use it")
+var light = flag.Bool("light", false, "Only keep block headers and verify the transactions addressed to us with merkel proofs")
+var account = flag.String("account", "default", "Keystore account the node signs with")
+var unlockTimeout = flag.Duration("unlock", 0, "Lock the account again after this long, 0 keeps it unlocked")
+var ledger = flag.Bool("ledger", false, "Keep account balances, transactions move amounts between keys")
+var encrypt = flag.Bool("encrypt", false, "Encrypt peer connections with TLS authenticated by the node key, every peer needs it too")
+var genesis = flag.String("genesis", "", "Hex hash of the genesis block of the network, the first one received when empty")
+var derivationPath = flag.String("path", "m/0'/0'", "Derivation path of new accounts when BLOCKCHAIN_MNEMONIC is set")
 
 func init() {
 	flag.Parse()
@@ -17,12 +34,159 @@ func init() {
 
 func main() {
 
-	core.Start(*address)
+	// Setup keys
+	keystore, err := core.OpenKeystore(core.KEYSTORE_DIRECTORY())
+	if err != nil {
+		log.Fatal("Opening keystore: ", err)
+	}
+
+	passphrase := os.Getenv("BLOCKCHAIN_PASSPHRASE")
+	if passphrase == "" {
+		fmt.Printf("Passphrase for %s: ", *account)
+		passphrase = ReadLine()
+	}
+
+	if _, err := keystore.Public(*account); err == core.ErrKeyNotFound {
+
+		if mnemonic := os.Getenv("BLOCKCHAIN_MNEMONIC"); mnemonic != "" {
+
+			fmt.Println("Deriving keypair", *derivationPath, "...")
+			if err := keystore.Import(*account, deriveKeypair(mnemonic, *derivationPath), passphrase); err != nil {
+				log.Fatal("Importing key: ", err)
+			}
+		} else {
+
+			fmt.Println("Generating keypair...")
+			if _, err := keystore.Create(*account, passphrase); err != nil {
+				log.Fatal("Creating key: ", err)
+			}
+		}
+	}
+	if err := keystore.Unlock(*account, passphrase, *unlockTimeout); err != nil {
+		log.Fatal("Unlocking ", *account, ": ", err)
+	}
+
+	store, err := core.OpenBlockStore(core.BLOCK_STORE_DIRECTORY())
+	if err != nil {
+		log.Fatal("Opening block store: ", err)
+	}
+
+	consensus := core.DefaultConsensusParams()
+	consensus.Ledger = *ledger
+	if *genesis != "" {
+		hash, err := hex.DecodeString(*genesis)
+		if err != nil || len(hash) != 32 {
+			log.Fatal("Genesis hash must be 32 hex encoded bytes")
+		}
+		copy(consensus.GenesisHash[:], hash)
+	}
+
+	node, err := core.NewNode(core.NodeOptions{
+		Keystore:  keystore,
+		Account:   *account,
+		Address:   *address,
+		Seeds:     core.SEED_NODES(),
+		Store:     store,
+		Light:     *light,
+		Consensus: consensus,
+
+		EncryptTransport: *encrypt,
+	})
+	if err != nil {
+		log.Fatal("Loading blockchain: ", err)
+	}
+
+	// Interrupting the process stops the node cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := node.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	rpc := core.NewRPCServer(node)
+	rpc.Token = *rpcToken
+	if *rpcAddress != "" {
+		if err := rpc.Listen(*rpcAddress); err != nil {
+			log.Fatal("Starting RPC server: ", err)
+		}
+	}
 
 	for {
-		str := <-ReadStdin()
-		core.Core.Blockchain.TransactionsQueue <- core.CreateTransaction(str)
+		var str string
+		select {
+		case str = <-ReadStdin():
+		case <-ctx.Done():
+			fmt.Println("Shutting down...")
+			rpc.Close()
+			node.Stop()
+			store.Close()
+			return
+		}
+
+		// Lines starting with @<public key> are addressed to that key, @<public key>:<amount> also
+		// transfers the amount
+		var to []byte
+		var amount uint64
+		if strings.HasPrefix(str, "@") {
+			fields := strings.SplitN(str[1:], " ", 2)
+			to, str = []byte(fields[0]), ""
+			if len(fields) > 1 {
+				str = fields[1]
+			}
+
+			if i := bytes.IndexByte(to, ':'); i >= 0 {
+				a, err := strconv.ParseUint(string(to[i+1:]), 10, 64)
+				if err != nil {
+					fmt.Println("Amounts are integers:", err)
+					continue
+				}
+				to, amount = to[:i], a
+			}
+		}
+
+		t, err := node.CreateTransfer(to, amount, node.EstimateFee(len(str)), str)
+		if err != nil {
+			fmt.Println("Transaction not created:", err)
+			continue
+		}
+		node.Blockchain.TransactionsQueue <- t
+	}
+}
+
+func deriveKeypair(mnemonic, path string) *core.Keypair {
+
+	seed, err := core.MnemonicToSeed(mnemonic, os.Getenv("BLOCKCHAIN_MNEMONIC_PASSPHRASE"))
+	if err != nil {
+		log.Fatal("Reading mnemonic: ", err)
 	}
+
+	master, err := core.NewMasterKey(seed)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	key, err := master.Derive(path)
+	if err != nil {
+		log.Fatal("Deriving ", path, ": ", err)
+	}
+
+	return key.Keypair()
+}
+
+// Reads a line without buffering, so nothing after it is taken from stdin
+func ReadLine() string {
+
+	line := []byte{}
+	b := make([]byte, 1)
+	for {
+		if n, err := os.Stdin.Read(b); n == 0 || err != nil || b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+
+	return strings.TrimSuffix(string(line), "\r")
 }
 
 func ReadStdin() chan string {
@@ -0,0 +1,189 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Addresses of the peers we know about and the last time anyone heard from them.
+// Addresses are hosts, every node listens on BLOCKCHAIN_PORT.
+type AddressBook struct {
+	addresses map[string]*KnownAddress
+	lock      sync.Mutex
+}
+
+type KnownAddress struct {
+	Address  string
+	LastSeen uint32
+}
+
+func NewAddressBook() *AddressBook {
+
+	return &AddressBook{addresses: map[string]*KnownAddress{}}
+}
+
+// Records that a peer was heard from. Returns true if the address wasn't known.
+// Timestamps in the future are clamped so a peer can't pin an address in our book.
+func (ab *AddressBook) Seen(address string, lastSeen uint32) bool {
+
+	now := uint32(time.Now().Unix())
+	if lastSeen > now {
+		lastSeen = now
+	}
+
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	if a := ab.addresses[address]; a != nil {
+
+		if lastSeen > a.LastSeen {
+			a.LastSeen = lastSeen
+		}
+		return false
+	}
+
+	if now-lastSeen > uint32(ADDRESS_BOOK_EXPIRY/time.Second) {
+		return false
+	}
+
+	if len(ab.addresses) >= MAX_ADDRESS_BOOK_SIZE {
+		ab.evictOldest()
+	}
+	ab.addresses[address] = &KnownAddress{address, lastSeen}
+
+	return true
+}
+
+func (ab *AddressBook) Len() int {
+
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	return len(ab.addresses)
+}
+
+// Most recently seen addresses first
+func (ab *AddressBook) Addresses(max int) []KnownAddress {
+
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	as := make([]KnownAddress, 0, len(ab.addresses))
+	for _, a := range ab.addresses {
+		as = append(as, *a)
+	}
+
+	sort.Slice(as, func(i, j int) bool {
+		if as[i].LastSeen != as[j].LastSeen {
+			return as[i].LastSeen > as[j].LastSeen
+		}
+		return as[i].Address < as[j].Address
+	})
+
+	if len(as) > max {
+		as = as[:max]
+	}
+
+	return as
+}
+
+// Forgets addresses nobody has seen for ADDRESS_BOOK_EXPIRY
+func (ab *AddressBook) Prune() {
+
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	limit := uint32(time.Now().Add(-ADDRESS_BOOK_EXPIRY).Unix())
+	for k, a := range ab.addresses {
+		if a.LastSeen < limit {
+			delete(ab.addresses, k)
+		}
+	}
+}
+
+func (ab *AddressBook) evictOldest() {
+
+	var oldest *KnownAddress
+	for _, a := range ab.addresses {
+		if oldest == nil || a.LastSeen < oldest.LastSeen {
+			oldest = a
+		}
+	}
+
+	if oldest != nil {
+		delete(ab.addresses, oldest.Address)
+	}
+}
+
+// Address lists are encoded as a count followed by every address:
+//
+//	last seen (4 bytes) | address length (1 byte) | address
+func MarshalAddresses(as []KnownAddress) []byte {
+
+	entries := new(bytes.Buffer)
+	count := uint32(0)
+	for _, a := range as {
+
+		if len(a.Address) > 255 {
+			continue
+		}
+		binary.Write(entries, binary.LittleEndian, a.LastSeen)
+		entries.WriteByte(byte(len(a.Address)))
+		entries.WriteString(a.Address)
+		count++
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, count)
+	buf.Write(entries.Bytes())
+
+	return buf.Bytes()
+}
+
+func UnmarshalAddresses(d []byte) ([]KnownAddress, error) {
+
+	if len(d) < 4 {
+		return nil, ErrEncodingTruncated
+	}
+
+	buf := bytes.NewBuffer(d)
+
+	var count uint32
+	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &count)
+	if count > MAX_NODES_PER_MESSAGE {
+		return nil, ErrEncodingOverrun
+	}
+
+	as := []KnownAddress{}
+	for i := uint32(0); i < count; i++ {
+
+		if buf.Len() < 5 {
+			return nil, ErrEncodingTruncated
+		}
+
+		a := KnownAddress{}
+		binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &a.LastSeen)
+		l, _ := buf.ReadByte()
+
+		if buf.Len() < int(l) {
+			return nil, ErrEncodingTruncated
+		}
+		a.Address = string(buf.Next(int(l)))
+
+		// Only hosts are accepted, peers can't make us dial arbitrary ports
+		if net.ParseIP(a.Address) == nil {
+			continue
+		}
+		as = append(as, a)
+	}
+
+	if buf.Len() > 0 {
+		return nil, ErrEncodingOverrun
+	}
+
+	return as, nil
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAddressBook(t *testing.T) {
+
+	ab := NewAddressBook()
+	now := uint32(time.Now().Unix())
+
+	if !ab.Seen("10.0.0.1", now-10) || !ab.Seen("10.0.0.2", now) {
+		t.Fatal("New addresses not added")
+	}
+	if ab.Seen("10.0.0.1", now-20) {
+		t.Error("Known address reported as new")
+	}
+	if ab.Seen("10.0.0.3", now-uint32(2*ADDRESS_BOOK_EXPIRY/time.Second)) {
+		t.Error("Expired address added")
+	}
+
+	// Future timestamps are clamped
+	ab.Seen("10.0.0.4", now+1000)
+
+	as := ab.Addresses(10)
+	if len(as) != 3 || as[2].Address != "10.0.0.1" || as[2].LastSeen != now-10 {
+		t.Error("Addresses not sorted by last seen", as)
+	}
+	if as[0].LastSeen > now+1 {
+		t.Error("Future timestamp not clamped")
+	}
+
+	if len(ab.Addresses(1)) != 1 {
+		t.Error("Addresses not capped")
+	}
+}
+
+func TestAddressesMarshalling(t *testing.T) {
+
+	as := []KnownAddress{{"10.0.0.1", 1000}, {"fe80::1", 2000}}
+
+	newAs, err := UnmarshalAddresses(MarshalAddresses(as))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(newAs, as) {
+		t.Error("Marshall, unmarshall addresses failed", newAs)
+	}
+
+	// Only hosts are accepted
+	newAs, _ = UnmarshalAddresses(MarshalAddresses([]KnownAddress{{"10.0.0.1:22", 1000}}))
+	if len(newAs) != 0 {
+		t.Error("Address with port accepted")
+	}
+
+	if _, err := UnmarshalAddresses(MarshalAddresses(as)[:10]); err != ErrEncodingTruncated {
+		t.Error("Truncated address list not rejected", err)
+	}
+}
@@ -3,12 +3,25 @@ package core
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"reflect"
 
-	"github.com/izqui/functional"
 	"github.com/izqui/helpers"
 )
 
+var (
+	ErrEncodingTruncated = errors.New("Encoded data is truncated")
+	ErrEncodingOverrun   = errors.New("Encoded length overruns its container")
+	ErrEncodingVersion   = errors.New("Unknown block encoding version")
+
+	ErrBlockTooLarge       = errors.New("Block is over the size limit")
+	ErrTooManyTransactions = errors.New("Block has more transactions than allowed")
+	ErrBadMerkleRoot       = errors.New("Block merkel root doesn't match its transactions")
+	ErrTargetAboveLimit    = errors.New("Block target is easier than the proof of work limit")
+	ErrBadBlockPow         = errors.New("Block hash is above its target")
+	ErrBadBlockSignature   = errors.New("Block signature is invalid")
+)
+
 type BlockSlice []Block
 
 func (bs BlockSlice) Exists(b Block) bool {
@@ -42,16 +55,19 @@ type Block struct {
 }
 
 type BlockHeader struct {
+	Version    uint32
 	Origin     []byte
 	PrevBlock  []byte
 	MerkelRoot []byte
 	Timestamp  uint32
-	Nonce      uint32
+	// Compact proof of work target, see CompactToTarget
+	Bits  uint32
+	Nonce uint32
 }
 
 func NewBlock(previousBlock []byte) Block {
 
-	header := &BlockHeader{PrevBlock: previousBlock}
+	header := &BlockHeader{Version: BLOCK_VERSION, PrevBlock: previousBlock, Bits: BLOCK_POW_LIMIT_BITS}
 	return Block{header, nil, new(TransactionSlice)}
 }
 
@@ -66,12 +82,66 @@ func (b *Block) Sign(keypair *Keypair) []byte {
 	return s
 }
 
-func (b *Block) VerifyBlock(prefix []byte) bool {
+// Checks the block on its own, the header first since it is the cheapest part: proof of work and
+// signature, then the consensus size limits, the coinbase and the merkel root.
+// Transaction signatures are checked by Blockchain.ValidateBlock and the rules that depend on the
+// chain when it is added.
+func (b *Block) VerifyBlock(params ConsensusParams) error {
+
+	if err := b.VerifyHeader(params.PowLimitBits); err != nil {
+		return err
+	}
+
+	if b.Version < BLOCK_VERSION_LEGACY_MERKLE || b.Version > BLOCK_VERSION {
+		return ErrBadBlockVersion
+	}
+	if b.TransactionSlice.Len() > params.MaxBlockTransactions {
+		return ErrTooManyTransactions
+	}
+	if b.Size() > params.MaxBlockSize {
+		return ErrBlockTooLarge
+	}
+	for _, t := range *b.TransactionSlice {
+		if len(t.Payload) > params.MaxPayloadSize {
+			return ErrPayloadTooLarge
+		}
+	}
+	if err := b.verifyCoinbase(params); err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(b.GenerateMerkelRoot(), b.BlockHeader.MerkelRoot) {
+		return ErrBadMerkleRoot
+	}
+
+	return nil
+}
+
+// Checks proof of work and signature, which only need the header.
+// The target can't be easier than powLimitBits, whether it is the right one for the block height
+// is checked by VerifyContext.
+func (b *Block) VerifyHeader(powLimitBits uint32) error {
 
 	headerHash := b.Hash()
-	merkel := b.GenerateMerkelRoot()
 
-	return reflect.DeepEqual(merkel, b.BlockHeader.MerkelRoot) && CheckProofOfWork(prefix, headerHash) && SignatureVerify(b.BlockHeader.Origin, b.Signature, headerHash)
+	if CompactToTarget(b.BlockHeader.Bits).Cmp(CompactToTarget(powLimitBits)) > 0 {
+		return ErrTargetAboveLimit
+	}
+	if !CheckProofOfWorkTarget(b.BlockHeader.Bits, headerHash) {
+		return ErrBadBlockPow
+	}
+	if !SignatureVerify(b.BlockHeader.Origin, b.Signature, headerHash) {
+		return ErrBadBlockSignature
+	}
+
+	return nil
+}
+
+// Encoded size in bytes
+func (b *Block) Size() int {
+
+	data, _ := b.MarshalBinary()
+	return len(data)
 }
 
 func (b *Block) Hash() []byte {
@@ -80,12 +150,12 @@ func (b *Block) Hash() []byte {
 	return helpers.SHA256(headerHash)
 }
 
-func (b *Block) GenerateNonce(prefix []byte) uint32 {
+func (b *Block) GenerateNonce() uint32 {
 
 	newB := b
 	for {
 
-		if CheckProofOfWork(prefix, newB.Hash()) {
+		if CheckProofOfWorkTarget(newB.BlockHeader.Bits, newB.Hash()) {
 			break
 		}
 
@@ -96,34 +166,14 @@ func (b *Block) GenerateNonce(prefix []byte) uint32 {
 }
 func (b *Block) GenerateMerkelRoot() []byte {
 
-	var merkell func(hashes [][]byte) []byte
-	merkell = func(hashes [][]byte) []byte {
-
-		l := len(hashes)
-		if l == 0 {
-			return nil
-		}
-		if l == 1 {
-			return hashes[0]
-		} else {
-
-			if l%2 == 1 {
-				return merkell([][]byte{merkell(hashes[:l-1]), hashes[l-1]})
-			}
-
-			bs := make([][]byte, l/2)
-			for i, _ := range bs {
-				j, k := i*2, (i*2)+1
-				bs[i] = helpers.SHA256(append(hashes[j], hashes[k]...))
-			}
-			return merkell(bs)
-		}
-	}
-
-	ts := functional.Map(func(t Transaction) []byte { return t.Hash() }, []Transaction(*b.TransactionSlice)).([][]byte)
-	return merkell(ts)
-
+	return merkleRoot(b.Version, b.transactionHashes())
 }
+
+// Blocks are encoded as:
+//
+//	version (1 byte) | header | signature | transaction slice
+//
+// where the transaction slice carries its own count and length prefixes.
 func (b *Block) MarshalBinary() ([]byte, error) {
 
 	bhb, err := b.BlockHeader.MarshalBinary()
@@ -136,12 +186,16 @@ func (b *Block) MarshalBinary() ([]byte, error) {
 		return nil, err
 	}
 
-	return append(append(bhb, sig...), tsb...), nil
+	return append(append(append([]byte{BLOCK_ENCODING_VERSION}, bhb...), sig...), tsb...), nil
 }
 
 func (b *Block) UnmarshalBinary(d []byte) error {
 
-	buf := bytes.NewBuffer(d)
+	if err := checkBlockEncodingHeader(d); err != nil {
+		return err
+	}
+
+	buf := bytes.NewBuffer(d[1:])
 
 	header := new(BlockHeader)
 	err := header.UnmarshalBinary(buf.Next(BLOCK_HEADER_SIZE))
@@ -163,14 +217,52 @@ func (b *Block) UnmarshalBinary(d []byte) error {
 	return nil
 }
 
+// Checks that an encoded block is well formed (version, lengths and transaction count)
+// without decoding any transaction. Returns the number of transactions in the block.
+func VerifyBlockEncoding(d []byte) (int, error) {
+
+	if err := checkBlockEncodingHeader(d); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err := scanTransactionSlice(d[1+BLOCK_HEADER_SIZE+NETWORK_KEY_SIZE:], func(record []byte) error {
+		count++
+		return nil
+	})
+
+	return count, err
+}
+
+func checkBlockEncodingHeader(d []byte) error {
+
+	if len(d) < 1 {
+		return ErrEncodingTruncated
+	}
+
+	// A new encoding gets its own case next to the ones already released
+	switch d[0] {
+	case BLOCK_ENCODING_VERSION:
+		if len(d) < 1+BLOCK_HEADER_SIZE+NETWORK_KEY_SIZE {
+			return ErrEncodingTruncated
+		}
+	default:
+		return ErrEncodingVersion
+	}
+
+	return nil
+}
+
 func (h *BlockHeader) MarshalBinary() ([]byte, error) {
 
 	buf := new(bytes.Buffer)
 
+	binary.Write(buf, binary.LittleEndian, h.Version)
 	buf.Write(helpers.FitBytesInto(h.Origin, NETWORK_KEY_SIZE))
 	binary.Write(buf, binary.LittleEndian, h.Timestamp)
 	buf.Write(helpers.FitBytesInto(h.PrevBlock, 32))
 	buf.Write(helpers.FitBytesInto(h.MerkelRoot, 32))
+	binary.Write(buf, binary.LittleEndian, h.Bits)
 	binary.Write(buf, binary.LittleEndian, h.Nonce)
 
 	return buf.Bytes(), nil
@@ -179,10 +271,12 @@ func (h *BlockHeader) MarshalBinary() ([]byte, error) {
 func (h *BlockHeader) UnmarshalBinary(d []byte) error {
 
 	buf := bytes.NewBuffer(d)
+	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &h.Version)
 	h.Origin = helpers.StripByte(buf.Next(NETWORK_KEY_SIZE), 0)
 	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &h.Timestamp)
 	h.PrevBlock = buf.Next(32)
 	h.MerkelRoot = buf.Next(32)
+	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &h.Bits)
 	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &h.Nonce)
 
 	return nil
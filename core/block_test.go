@@ -15,6 +15,7 @@ func TestMerkellHash(t *testing.T) {
 	tr4 := NewTransaction(nil, nil, []byte(helpers.RandomString(helpers.RandomInt(0, 1024*1024))))
 
 	b := new(Block)
+	b.BlockHeader = &BlockHeader{Version: BLOCK_VERSION_LEGACY_MERKLE}
 	b.TransactionSlice = &TransactionSlice{*tr1, *tr2, *tr3, *tr4}
 
 	mt := b.GenerateMerkelRoot()
@@ -25,6 +26,59 @@ func TestMerkellHash(t *testing.T) {
 	}
 }
 
+func TestTaggedMerkelHash(t *testing.T) {
+
+	tr1 := NewTransaction(nil, nil, []byte("1"))
+	tr2 := NewTransaction(nil, nil, []byte("2"))
+	tr3 := NewTransaction(nil, nil, []byte("3"))
+
+	b := NewBlock(nil)
+	b.TransactionSlice = &TransactionSlice{*tr1, *tr2, *tr3}
+
+	leaf := func(h []byte) []byte { return helpers.SHA256(append([]byte{0}, h...)) }
+	node := func(l, r []byte) []byte { return helpers.SHA256(append(append([]byte{1}, l...), r...)) }
+
+	// The odd leaf goes up unpaired
+	manual := node(node(leaf(tr1.Hash()), leaf(tr2.Hash())), leaf(tr3.Hash()))
+
+	if !reflect.DeepEqual(b.GenerateMerkelRoot(), manual) {
+		t.Error("Tagged merkel tree generation fails")
+	}
+
+	// An inner node can't be passed off as a transaction
+	b.MerkelRoot = manual
+	inner := &MerkleProof{node(leaf(tr1.Hash()), leaf(tr2.Hash())), 0, []MerkleProofStep{{leaf(tr3.Hash()), false}}}
+	if VerifyMerkleProof(b.BlockHeader, inner) {
+		t.Error("Inner node proven as a transaction")
+	}
+}
+
+func TestLegacyBlock(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	b := newTestBlock(kp, nil, newTestTransaction(kp), newTestTransaction(kp))
+	b.Version = BLOCK_VERSION_LEGACY_MERKLE
+	b.MerkelRoot = b.GenerateMerkelRoot()
+	b.Signature = b.Sign(kp)
+
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := Block{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.GenerateMerkelRoot(), b.MerkelRoot) {
+		t.Error("Decoded version 1 block doesn't use the legacy merkel tree")
+	}
+
+	bl := newTestNode(kp).Blockchain
+	if err := bl.AddBlock(decoded); err != nil {
+		t.Error("Version 1 block rejected", err)
+	}
+}
+
 //TODO: Write block validation and marshalling tests [Issue: https://github.com/izqui/blockchain/issues/2]
 
 /*
@@ -100,3 +154,134 @@ func TestIncorrectBlockSignatureVerification(t *testing.T) {
 	}
 }
 */
+
+func TestBlockEncoding(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	b := NewBlock(nil)
+	b.BlockHeader.Origin = kp.Public
+
+	// Transactions without payload used to be dropped when decoding
+	for _, payload := range [][]byte{nil, []byte(helpers.RandomString(helpers.RandomInt(1, 1024)))} {
+		tr := NewTransaction(kp.Public, nil, payload)
+		tr.Signature = tr.Sign(kp)
+		b.AddTransaction(tr)
+	}
+	b.BlockHeader.MerkelRoot = b.GenerateMerkelRoot()
+	b.Signature = b.Sign(kp)
+
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := VerifyBlockEncoding(data); err != nil || n != 2 {
+		t.Error("Block encoding verification fails", n, err)
+	}
+
+	newB := new(Block)
+	if err := newB.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(newB.Hash(), b.Hash()) || newB.TransactionSlice.Len() != 2 || !reflect.DeepEqual(newB.GenerateMerkelRoot(), b.BlockHeader.MerkelRoot) {
+		t.Error("Marshall, unmarshall failed")
+	}
+
+	if err := new(Block).UnmarshalBinary(data[:len(data)-1]); err != ErrEncodingTruncated {
+		t.Error("Truncated block not rejected", err)
+	}
+
+	if _, err := VerifyBlockEncoding(append(data, 0)); err != ErrEncodingOverrun {
+		t.Error("Trailing bytes not rejected", err)
+	}
+
+	data[0] = BLOCK_ENCODING_VERSION + 1
+	if err := new(Block).UnmarshalBinary(data); err != ErrEncodingVersion {
+		t.Error("Unknown version not rejected", err)
+	}
+}
+
+func TestBlockLimits(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	params := DefaultConsensusParams()
+	params.MaxBlockTransactions = 3
+	params.MaxPayloadSize = 16
+
+	// Coinbase collecting the fees, proof of work and signature
+	mine := func(b *Block) {
+		fees, _ := TransactionFees((*b.TransactionSlice)[1:])
+		b.Coinbase().Header.Amount += fees
+		b.MerkelRoot = b.GenerateMerkelRoot()
+		b.Nonce = b.GenerateNonce()
+		b.Signature = b.Sign(kp)
+	}
+
+	b := newTestBlock(kp, nil, newTestTransaction(kp, withPayload("fee")), newTestTransaction(kp, withPayload("fee"), withFee(1)))
+	mine(&b)
+	if err := b.VerifyBlock(params); err != nil {
+		t.Fatal("Block within the limits fails verification", err)
+	}
+
+	b.MerkelRoot = helpers.SHA256(nil)
+	b.Nonce = b.GenerateNonce()
+	b.Signature = b.Sign(kp)
+	if err := b.VerifyBlock(params); err != ErrBadMerkleRoot {
+		t.Error("Wrong merkel root not rejected", err)
+	}
+
+	params.MaxBlockSize = b.Size() - 1
+	if err := b.VerifyBlock(params); err != ErrBlockTooLarge {
+		t.Error("Block over the size limit not rejected", err)
+	}
+	params.MaxBlockSize = MAX_BLOCK_SIZE
+
+	b = newTestBlock(kp, nil, newTestTransaction(kp, withPayload("fee")), newTestTransaction(kp, withPayload("fee"), withFee(1)), newTestTransaction(kp, withPayload("fee"), withFee(2)))
+	mine(&b)
+	if err := b.VerifyBlock(params); err != ErrTooManyTransactions {
+		t.Error("Block over the transaction limit not rejected", err)
+	}
+
+	big := NewTransaction(kp.Public, nil, make([]byte, params.MaxPayloadSize+1))
+	big.Signature = big.Sign(kp)
+	if err := big.VerifyTransaction(helpers.ArrayOfBytes(TEST_TRANSACTION_POW_COMPLEXITY, TEST_POW_PREFIX), params); err != ErrPayloadTooLarge {
+		t.Error("Transaction over the payload limit not rejected", err)
+	}
+
+	b = newTestBlock(kp, nil, big)
+	mine(&b)
+	if err := b.VerifyBlock(params); err != ErrPayloadTooLarge {
+		t.Error("Block with a payload over the limit not rejected", err)
+	}
+}
+
+func TestBlockTemplateLimits(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	params := DefaultConsensusParams()
+	params.MaxBlockTransactions = 3
+
+	node, err := NewNode(NodeOptions{Keypair: kp, Consensus: params})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := node.Blockchain
+
+	// Same size for every transaction, so their fee rates compare as their fees
+	for fee := uint64(1); fee <= 5; fee++ {
+		bl.Mempool.Add(*newTestTransaction(kp, withPayload("fee"), withFee(fee)))
+	}
+
+	b := bl.NewBlockTemplate()
+	if b.TransactionSlice.Len() != 3 || (*b.TransactionSlice)[1].Header.Fee != 5 {
+		t.Error("Template doesn't fill the transaction limit with the highest fees", b.TransactionSlice.Len())
+	}
+
+	// Room for the coinbase and a single transaction
+	node.options.Consensus.MaxBlockSize = b.Size() - newTestTransaction(kp, withPayload("fee"), withFee(1)).Size() - 1
+	b = bl.NewBlockTemplate()
+	if b.TransactionSlice.Len() != 2 || b.Size() > node.options.Consensus.MaxBlockSize {
+		t.Error("Template over the size limit", b.TransactionSlice.Len(), b.Size())
+	}
+}
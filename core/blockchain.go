@@ -1,15 +1,22 @@
 package core
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"reflect"
+	"sync"
 	"time"
-
-	"github.com/izqui/helpers"
 )
 
 type TransactionsQueue chan *Transaction
-type BlocksQueue chan Block
+type BlocksQueue chan QueuedBlock
+
+// Block waiting to be validated and the peer that sent it, empty for the blocks we mine
+type QueuedBlock struct {
+	Block
+	Peer string
+}
 
 type Blockchain struct {
 	CurrentBlock Block
@@ -17,18 +24,54 @@ type Blockchain struct {
 
 	TransactionsQueue
 	BlocksQueue
+
+	Tree    *BlockTree
+	Orphans *OrphanPool
+	Mempool *Mempool
+	Store   *BlockStore
+	Index   *TransactionIndex
+	// Transactions already verified, by the mempool or in an earlier block
+	Verified *VerifiedCache
+	// Only kept by full nodes of ledger chains
+	Ledger *Ledger
+
+	node *Node
+	lock sync.RWMutex
 }
 
-func SetupBlockchan() *Blockchain {
+func SetupBlockchan(node *Node, store *BlockStore) (*Blockchain, error) {
 
 	bl := new(Blockchain)
+	bl.node = node
 	bl.TransactionsQueue, bl.BlocksQueue = make(TransactionsQueue), make(BlocksQueue)
+	bl.Tree, bl.Orphans, bl.Mempool = NewBlockTree(), NewOrphanPool(), NewMempool()
+	bl.Index = NewTransactionIndex()
+	bl.Verified = NewVerifiedCache(VERIFIED_TRANSACTIONS_CACHE_SIZE)
+	if node.options.Consensus.Ledger && !node.options.Light {
+		bl.Ledger = NewLedger()
+	}
+	bl.Store = store
+	bl.CurrentBlock = bl.CreateNewBlock()
 
-	//Read blockchain from file and stuff...
+	if store != nil {
 
-	bl.CurrentBlock = bl.CreateNewBlock()
+		blocks, err := store.Blocks()
+		if err != nil {
+			return nil, err
+		}
+
+		// The store has every block we accepted, side branches included, parents always before children
+		for _, b := range blocks {
+			if _, err := bl.Tree.Insert(b); err != nil {
+				fmt.Println("Skipping stored block", b.Hash(), err)
+			}
+		}
+		bl.reorganize(nil, bl.Tree.Tip)
+
+		fmt.Println("Loaded", len(blocks), "blocks from disk, chain height", len(bl.BlockSlice))
+	}
 
-	return bl
+	return bl, nil
 }
 
 func (bl *Blockchain) CreateNewBlock() Block {
@@ -41,85 +84,524 @@ func (bl *Blockchain) CreateNewBlock() Block {
 	}
 
 	b := NewBlock(prevBlockHash)
-	b.BlockHeader.Origin = Core.Keypair.Public
+	b.BlockHeader.Origin = bl.node.Keypair.Public
+	b.BlockHeader.Bits = NextBlockBits(bl.Tree.Tip, bl.node.options.Consensus)
+
+	return b
+}
+
+// Stores the block and adds it to the tree. If the block moves the tip to a different branch
+// the chain is reorganized and the pending transactions updated.
+func (bl *Blockchain) AddBlock(b Block) error {
+
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+
+	if bl.Tree.Has(b.Hash()) {
+		return nil
+	}
+	if !b.IsGenesis() && !bl.Tree.Has(b.PrevBlock) {
+		return ErrOrphanBlock
+	}
+	parent := bl.Tree.Get(b.PrevBlock)
+	if err := bl.Tree.CheckBranch(b, parent, bl.node.options.Consensus); err != nil {
+		return err
+	}
+	// Orphans are only checked here, once their parent arrives
+	if err := b.VerifyContext(parent, bl.node.options.Consensus, time.Now()); err != nil {
+		return err
+	}
+
+	height := 0
+	if parent != nil {
+		height = parent.Height + 1
+	}
+	// Light nodes only have the header
+	if !bl.node.options.Light {
+		if c := b.Coinbase(); c == nil || c.Header.Sequence != uint64(height) {
+			return ErrBadCoinbase
+		}
+	}
+	if bl.Ledger != nil {
+		if err := bl.ledgerAt(parent).Connect(b); err != nil {
+			return err
+		}
+	}
+
+	if bl.Store != nil {
+		if err := bl.Store.Append(b); err != nil {
+			return err
+		}
+	}
+
+	oldTip := bl.Tree.Tip
+	if _, err := bl.Tree.Insert(b); err != nil {
+		return err
+	}
+
+	if bl.Tree.Tip != oldTip {
+		bl.reorganize(oldTip, bl.Tree.Tip)
+	}
+
+	return nil
+}
+
+// Adds a verified block sent by peer. If its parent is missing it waits in the orphan pool,
+// otherwise it is added together with every orphan that descends from it. Orphans that fail to be
+// added are dropped with their descendants. Returns true if the tip changed.
+func (bl *Blockchain) ProcessBlock(b Block, peer string) (bool, error) {
+
+	// Light nodes also add the headers they sync from the message handlers, the tree is only
+	// read under the lock
+	bl.lock.Lock()
+	oldTip := bl.Tree.Tip
+	if !b.IsGenesis() && !bl.Tree.Has(b.PrevBlock) {
+
+		bl.Orphans.Add(b, peer)
+		bl.lock.Unlock()
+
+		return false, ErrOrphanBlock
+	}
+	bl.lock.Unlock()
+
+	if err := bl.AddBlock(b); err != nil {
+		return false, err
+	}
+
+	bl.lock.Lock()
+	queue := bl.Orphans.TakeChildren(b.Hash())
+	bl.lock.Unlock()
+
+	for len(queue) > 0 {
+
+		b := queue[0]
+		queue = queue[1:]
+
+		// A bad orphan only takes its own descendants with it, its siblings still connect
+		if err := bl.AddBlock(b); err != nil {
+			fmt.Println("Dropping orphan", b.Hash(), "and its descendants:", err)
+
+			bl.lock.Lock()
+			bl.Orphans.DropDescendants(b.Hash())
+			bl.lock.Unlock()
+			continue
+		}
+
+		bl.lock.Lock()
+		queue = append(queue, bl.Orphans.TakeChildren(b.Hash())...)
+		bl.lock.Unlock()
+	}
+
+	return bl.tipNode() != oldTip, nil
+}
+
+func (bl *Blockchain) tipNode() *BlockNode {
+
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	return bl.Tree.Tip
+}
+
+func (bl *Blockchain) HasBlock(hash []byte) bool {
+
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	return bl.Tree.Has(hash) || bl.Orphans.Has(hash)
+}
+
+// Last block of the main chain, nil while the chain is empty
+func (bl *Blockchain) Tip() *Block {
+
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	if bl.Tree.Tip == nil {
+		return nil
+	}
+
+	return &bl.Tree.Tip.Block
+}
+
+func (bl *Blockchain) GetBlock(hash []byte) *Block {
+
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	n := bl.Tree.Get(hash)
+	if n == nil {
+		return nil
+	}
+
+	return &n.Block
+}
+
+// Block of the main chain at the given height, nil if the chain is shorter
+func (bl *Blockchain) BlockAt(height int) *Block {
+
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	if height < 0 || height >= len(bl.BlockSlice) {
+		return nil
+	}
+
+	b := bl.BlockSlice[height]
+	return &b
+}
+
+// Height of a block in its branch, -1 if the block is unknown
+func (bl *Blockchain) BlockHeight(hash []byte) int {
+
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	n := bl.Tree.Get(hash)
+	if n == nil {
+		return -1
+	}
+
+	return n.Height
+}
+
+// Looks for a transaction of the main chain in the index.
+// Returns the transaction and the block that includes it.
+func (bl *Blockchain) FindTransaction(hash []byte) (*Transaction, *Block) {
+
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	p, ok := bl.Index.hashes[string(hash)]
+	if !ok {
+		return nil, nil
+	}
+	b := bl.BlockSlice[p.Height]
+	t := (*b.TransactionSlice)[p.Index]
+
+	return &t, &b
+}
+
+// Hashes of the main chain going back from the tip, dense at first and then doubling the step,
+// so a peer can find where our chains fork with a short list.
+func (bl *Blockchain) Locator() [][]byte {
+
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	locator := [][]byte{}
+	step := 1
+	for i := len(bl.BlockSlice) - 1; i >= 0; i -= step {
+
+		locator = append(locator, bl.BlockSlice[i].Hash())
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+
+	return locator
+}
+
+// Main chain headers following the first locator hash that is in our main chain
+func (bl *Blockchain) HeadersAfter(locator [][]byte, max int) BlockSlice {
+
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	start := 0
+	for _, h := range locator {
+
+		if bl.inMainChain(h) {
+			start = bl.Tree.Get(h).Height + 1
+			break
+		}
+	}
+
+	headers := BlockSlice{}
+	for i := start; i < len(bl.BlockSlice) && len(headers) < max; i++ {
+
+		b := bl.BlockSlice[i]
+		headers = append(headers, Block{b.BlockHeader, b.Signature, new(TransactionSlice)})
+	}
+
+	return headers
+}
+
+// True if the block is in the main chain, the caller holds bl.lock
+func (bl *Blockchain) inMainChain(hash []byte) bool {
+
+	n := bl.Tree.Get(hash)
+	return n != nil && n.Height < len(bl.BlockSlice) && reflect.DeepEqual(bl.BlockSlice[n.Height].Hash(), n.Hash)
+}
+
+// Moves the main chain from oldTip to newTip, rolling back the blocks of the abandoned branch
+// and applying the ones of the new branch.
+func (bl *Blockchain) reorganize(oldTip, newTip *BlockNode) {
+
+	fork := FindFork(oldTip, newTip)
+
+	disconnected := 0
+	for n := oldTip; n != fork; n = n.Parent {
+		bl.disconnectBlock(n.Block)
+		disconnected++
+	}
+
+	branch := []*BlockNode{}
+	for n := newTip; n != fork; n = n.Parent {
+		branch = append(branch, n)
+	}
+	for i := len(branch) - 1; i >= 0; i-- {
+		bl.connectBlock(branch[i].Block)
+	}
+
+	if disconnected > 0 {
+		fmt.Println("Reorganized chain,", disconnected, "blocks rolled back,", len(branch), "applied")
+	}
+
+	bl.CurrentBlock = bl.NewBlockTemplate()
+}
+
+// New block on top of the tip with the mempool transactions paying the highest fee per byte that
+// fit in the consensus block limits, and our coinbase collecting their fees.
+func (bl *Blockchain) NewBlockTemplate() Block {
+
+	params := bl.node.options.Consensus
+	b := bl.CreateNewBlock()
+
+	height := 0
+	if bl.Tree.Tip != nil {
+		height = bl.Tree.Tip.Height + 1
+	}
+	coinbase := NewCoinbase(b.Origin, height, BlockSubsidy(height, params))
+
+	// Encoding version, header, signature, transaction count and the coinbase with its length
+	size := 1 + BLOCK_HEADER_SIZE + NETWORK_KEY_SIZE + 4 + coinbase.Size() + 4
+
+	ts := bl.Mempool.Select(params.MaxBlockTransactions-1, params.MaxBlockSize-size)
+	if bl.Ledger != nil {
+		ts = bl.ledgerTransactions(ts)
+	}
+
+	fees, err := TransactionFees(ts)
+	if err != nil || fees > math.MaxUint64-coinbase.Header.Amount {
+		fees, ts = 0, TransactionSlice{}
+	}
+	coinbase.Header.Amount += fees
+
+	ts = append(TransactionSlice{*coinbase}, ts...)
+	b.TransactionSlice = &ts
 
 	return b
 }
 
-func (bl *Blockchain) AddBlock(b Block) {
+// Transactions that can go in the block on top of the tip. A sender's transactions can come in
+// any order from the mempool, so they are tried again while some of them get in.
+func (bl *Blockchain) ledgerTransactions(ts TransactionSlice) TransactionSlice {
+
+	v := bl.Ledger.View()
+	valid := TransactionSlice{}
+	for added := true; added; {
+
+		added = false
+		rest := TransactionSlice{}
+		for _, t := range ts {
+			if v.ApplyTransaction(t) == nil {
+				valid = append(valid, t)
+				added = true
+			} else {
+				rest = append(rest, t)
+			}
+		}
+		ts = rest
+	}
+
+	return valid
+}
+
+// Account state after parent, which may be in a side branch: the main chain is rolled back
+// to the fork and the branch applied on a view of the ledger.
+func (bl *Blockchain) ledgerAt(parent *BlockNode) *LedgerView {
+
+	v := bl.Ledger.View()
 
+	fork := FindFork(bl.Tree.Tip, parent)
+	for n := bl.Tree.Tip; n != fork; n = n.Parent {
+		v.Disconnect(n.Block)
+	}
+
+	branch := []*BlockNode{}
+	for n := parent; n != fork; n = n.Parent {
+		branch = append(branch, n)
+	}
+	for i := len(branch) - 1; i >= 0; i-- {
+		v.Connect(branch[i].Block)
+	}
+
+	return v
+}
+
+// Next sequence number of key, counting its transactions waiting in the mempool
+func (bl *Blockchain) NextSequence(key []byte) uint64 {
+
+	if bl.Ledger == nil {
+		return 0
+	}
+
+	return bl.Ledger.Account(key).Sequence + uint64(bl.Mempool.Pending(key)) + 1
+}
+
+func (bl *Blockchain) connectBlock(b Block) {
+
+	if bl.Ledger != nil {
+		if err := bl.Ledger.Connect(b); err != nil {
+			fmt.Println("Ledger rejects block", b.Hash(), err)
+		}
+	}
+	bl.Index.connect(len(bl.BlockSlice), b)
 	bl.BlockSlice = append(bl.BlockSlice, b)
+	bl.Mempool.RemoveTransactions(*b.TransactionSlice)
+}
+
+// Transactions of a rolled back block go back to the mempool, except its coinbase
+func (bl *Blockchain) disconnectBlock(b Block) {
+
+	bl.BlockSlice = bl.BlockSlice[:len(bl.BlockSlice)-1]
+	bl.Index.disconnect(len(bl.BlockSlice), b)
+	if bl.Ledger != nil {
+		bl.Ledger.Disconnect(b)
+	}
+	if bl.node.SPVClient != nil {
+		bl.node.SPVClient.Disconnect(b.Hash())
+	}
+
+	for _, t := range *b.TransactionSlice {
+		if !t.IsCoinbase() {
+			bl.Mempool.Add(t)
+		}
+	}
 }
 
-func (bl *Blockchain) Run() {
+func (bl *Blockchain) Run(ctx context.Context) {
+
+	// Light nodes don't mine
+	var interruptBlockGen chan Block
+	if !bl.node.options.Light {
+		interruptBlockGen = bl.GenerateBlocks(ctx)
+	}
+	interrupt := func() {
+		if interruptBlockGen != nil {
+			select {
+			case interruptBlockGen <- bl.CurrentBlock:
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	expire := time.NewTicker(MEMPOOL_EXPIRY_INTERVAL)
+	defer expire.Stop()
+
+	// Blocks reach the loop once their header, body and transactions are verified
+	validBlocks := bl.validateBlocks(ctx)
 
-	interruptBlockGen := bl.GenerateBlocks()
 	for {
 		select {
 		case tr := <-bl.TransactionsQueue:
 
-			if bl.CurrentBlock.TransactionSlice.Exists(*tr) {
+			if bl.Mempool.Has(tr.Hash()) {
+				continue
+			}
+			if err := bl.VerifyTransaction(tr); err != nil {
+				fmt.Println("Recieved non valid transaction", tr.Hash(), err)
 				continue
 			}
-			if !tr.VerifyTransaction(TRANSACTION_POW) {
-				fmt.Println("Recieved non valid transaction", tr)
+			if err := bl.checkPendingTransaction(*tr); err != nil {
+				fmt.Println("Transaction not added to mempool:", err)
 				continue
 			}
 
-			bl.CurrentBlock.AddTransaction(tr)
-			interruptBlockGen <- bl.CurrentBlock
+			if err := bl.Mempool.Add(*tr); err != nil {
+				fmt.Println("Transaction not added to mempool:", err)
+				continue
+			}
+
+			bl.CurrentBlock = bl.NewBlockTemplate()
+			interrupt()
 
 			//Broadcast transaction to the network
 			mes := NewMessage(MESSAGE_SEND_TRANSACTION)
 			mes.Data, _ = tr.MarshalBinary()
 
-			time.Sleep(300 * time.Millisecond)
-			Core.Network.BroadcastQueue <- *mes
+			bl.node.Network.BroadcastQueue <- *mes
 
-		case b := <-bl.BlocksQueue:
+		case queued := <-validBlocks:
 
-			if bl.BlockSlice.Exists(b) {
-				fmt.Println("block exists")
-				continue
+			b := queued.Block
+			if bl.node.options.Light {
+				b = Block{b.BlockHeader, b.Signature, new(TransactionSlice)}
 			}
 
-			if !b.VerifyBlock(BLOCK_POW) {
-				fmt.Println("block verification fails")
-				continue
-			}
-
-			if reflect.DeepEqual(b.PrevBlock, bl.CurrentBlock.Hash()) {
+			tipChanged, err := bl.ProcessBlock(b, queued.Peer)
+			if err == ErrOrphanBlock {
 				// I'm missing some blocks in the middle. Request'em.
 				fmt.Println("Missing blocks in between")
-			} else {
-
-				fmt.Println("New block!", b.Hash())
-
-				transDiff := TransactionSlice{}
+				bl.node.Syncer.RequestMissing()
+				continue
+			}
+			if err != nil {
+				fmt.Println("Error adding block", err)
+			}
 
-				if !reflect.DeepEqual(b.BlockHeader.MerkelRoot, bl.CurrentBlock.MerkelRoot) {
-					// Transactions are different
-					fmt.Println("Transactions are different. finding diff")
-					transDiff = DiffTransactionSlices(*bl.CurrentBlock.TransactionSlice, *b.TransactionSlice)
-				}
+			tip := bl.tipNode()
+			if tipChanged && bl.node.options.Light {
+				fmt.Println("New header!", tip.Hash)
+				// Only once the block is in our best chain
+				bl.node.SPVClient.ScanBlock(queued.Block)
+			} else if tipChanged {
 
-				bl.AddBlock(b)
+				fmt.Println("New block!", tip.Hash)
 
 				//Broadcast block and shit
 				mes := NewMessage(MESSAGE_SEND_BLOCK)
-				mes.Data, _ = b.MarshalBinary()
-				Core.Network.BroadcastQueue <- *mes
+				mes.Data, _ = tip.Block.MarshalBinary()
+				bl.node.Network.BroadcastQueue <- *mes
 
-				//New Block
-				bl.CurrentBlock = bl.CreateNewBlock()
-				bl.CurrentBlock.TransactionSlice = &transDiff
+				interrupt()
+			}
 
-				interruptBlockGen <- bl.CurrentBlock
+		case <-expire.C:
+			if bl.Mempool.Expire(time.Now()) > 0 {
+				bl.CurrentBlock = bl.NewBlockTemplate()
+				interrupt()
 			}
+
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
+// Transactions waiting in the mempool may depend on others of the same sender, so only a replayed
+// sequence or an amount the sender can't have is rejected
+func (bl *Blockchain) checkPendingTransaction(t Transaction) error {
+
+	if bl.Ledger == nil {
+		return nil
+	}
+
+	from := bl.Ledger.Account(t.Header.From)
+	if t.Header.Sequence <= from.Sequence {
+		return ErrBadSequence
+	}
+	if t.Header.Amount > 0 && len(t.Header.To) == 0 {
+		return ErrNoRecipient
+	}
+	if t.Header.Fee > math.MaxUint64-t.Header.Amount || t.Header.Amount+t.Header.Fee > from.Balance {
+		return ErrInsufficientBalance
+	}
+
+	return nil
+}
+
 func DiffTransactionSlices(a, b TransactionSlice) (diff TransactionSlice) {
 	//Assumes transaction arrays are sorted (which maybe is too big of an assumption)
 	lastj := 0
@@ -140,15 +622,24 @@ func DiffTransactionSlices(a, b TransactionSlice) (diff TransactionSlice) {
 	return
 }
 
-func (bl *Blockchain) GenerateBlocks() chan Block {
+// Mines on the blocks sent to the returned channel until ctx is done
+func (bl *Blockchain) GenerateBlocks(ctx context.Context) chan Block {
 
 	interrupt := make(chan Block)
 
-	go func() {
+	bl.node.spawn(func() {
 
-		block := <-interrupt
+		var block Block
+		select {
+		case block = <-interrupt:
+		case <-ctx.Done():
+			return
+		}
 	loop:
 		fmt.Println("Starting Proof of Work...")
+		// The template header is shared with CurrentBlock, work on a copy
+		header := *block.BlockHeader
+		block.BlockHeader = &header
 		block.BlockHeader.MerkelRoot = block.GenerateMerkelRoot()
 		block.BlockHeader.Nonce = 0
 		block.BlockHeader.Timestamp = uint32(time.Now().Unix())
@@ -156,14 +647,23 @@ func (bl *Blockchain) GenerateBlocks() chan Block {
 		for true {
 
 			sleepTime := time.Nanosecond
-			if block.TransactionSlice.Len() > 0 {
+			// Only mine when there is something besides our coinbase
+			if block.TransactionSlice.Len() > 1 {
 
-				if CheckProofOfWork(BLOCK_POW, block.Hash()) {
+				if CheckProofOfWorkTarget(block.Bits, block.Hash()) {
 
-					block.Signature = block.Sign(Core.Keypair)
-					bl.BlocksQueue <- block
 					sleepTime = time.Hour * 24
-					fmt.Println("Found Block!")
+					if kp, err := bl.node.SigningKeypair(); err != nil {
+						fmt.Println("Found Block but can't sign it:", err)
+					} else {
+						block.Signature = block.Sign(kp)
+						select {
+						case bl.BlocksQueue <- QueuedBlock{block, ""}:
+						case <-ctx.Done():
+							return
+						}
+						fmt.Println("Found Block!")
+					}
 
 				} else {
 
@@ -178,11 +678,13 @@ func (bl *Blockchain) GenerateBlocks() chan Block {
 			select {
 			case block = <-interrupt:
 				goto loop
-			case <-helpers.Timeout(sleepTime):
+			case <-time.After(sleepTime):
 				continue
+			case <-ctx.Done():
+				return
 			}
 		}
-	}()
+	})
 
 	return interrupt
 }
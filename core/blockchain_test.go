@@ -1,8 +1,10 @@
 package core
 
 import (
+	"context"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/izqui/helpers"
 )
@@ -20,3 +22,227 @@ func TestBlockDiff(t *testing.T) {
 		t.Error("Diffing algorithm fails")
 	}
 }
+
+func newTestNode(kp *Keypair) *Node {
+
+	node, err := NewNode(NodeOptions{Keypair: kp})
+	if err != nil {
+		panic(err)
+	}
+
+	return node
+}
+
+// Block on top of parent, nil for a genesis block, starting with a coinbase for kp
+func newTestBlock(kp *Keypair, parent *Block, trs ...*Transaction) Block {
+
+	prev, height := []byte(nil), 0
+	if parent != nil {
+		prev, height = parent.Hash(), int(parent.Coinbase().Header.Sequence)+1
+	}
+
+	b := NewBlock(prev)
+	b.BlockHeader.Origin = kp.Public
+	for _, tr := range trs {
+		b.AddTransaction(tr)
+	}
+	coinbase := NewCoinbase(kp.Public, height, BlockSubsidy(height, DefaultConsensusParams()))
+	*b.TransactionSlice = append(TransactionSlice{*coinbase}, *b.TransactionSlice...)
+
+	b.BlockHeader.MerkelRoot = b.GenerateMerkelRoot()
+	b.Signature = b.Sign(kp)
+
+	return b
+}
+
+// Changes a test transaction before it is signed
+type testTransactionOption func(*Transaction)
+
+// Signed transaction from kp with a random payload, the options change it before signing
+func newTestTransaction(kp *Keypair, options ...testTransactionOption) *Transaction {
+
+	tr := NewTransaction(kp.Public, nil, []byte(helpers.RandomString(helpers.RandomInt(1, 1024))))
+	for _, option := range options {
+		option(tr)
+	}
+	tr.Signature = tr.Sign(kp)
+
+	return tr
+}
+
+func withPayload(payload string) testTransactionOption {
+
+	return func(tr *Transaction) {
+		tr.Payload = []byte(payload)
+		tr.Header.PayloadHash = helpers.SHA256(tr.Payload)
+		tr.Header.PayloadLength = uint32(len(tr.Payload))
+	}
+}
+
+func withTransfer(to []byte, amount, sequence uint64) testTransactionOption {
+
+	return func(tr *Transaction) {
+		tr.Header.To = to
+		tr.Header.Amount = amount
+		tr.Header.Sequence = sequence
+	}
+}
+
+func withFee(fee uint64) testTransactionOption {
+
+	return func(tr *Transaction) {
+		tr.Header.Fee = fee
+	}
+}
+
+// Mines the transaction proof of work, it goes after the options that change the header
+func withPow() testTransactionOption {
+
+	return func(tr *Transaction) {
+		tr.Header.Nonce = tr.GenerateNonce(TRANSACTION_POW)
+	}
+}
+
+func TestChainReorganization(t *testing.T) {
+
+	// The branches are mined by different keys, so their coinbases differ
+	kp, minerKp := GenerateNewKeypair(), GenerateNewKeypair()
+	bl := newTestNode(kp).Blockchain
+
+	tr1, tr2, tr3 := newTestTransaction(kp), newTestTransaction(kp), newTestTransaction(kp)
+
+	genesis := newTestBlock(kp, nil, tr1)
+	a1 := newTestBlock(kp, &genesis, tr2)
+	for _, b := range []Block{genesis, a1} {
+		if err := bl.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !reflect.DeepEqual(bl.PreviousBlock().Hash(), a1.Hash()) {
+		t.Fatal("Tip should be a1")
+	}
+
+	unknown := newTestBlock(kp, &a1, newTestTransaction(kp))
+	if err := bl.AddBlock(newTestBlock(kp, &unknown)); err != ErrOrphanBlock {
+		t.Error("Orphan block was added", err)
+	}
+
+	// Competing branch with the same work doesn't move the tip
+	b1 := newTestBlock(minerKp, &genesis, tr3)
+	bl.AddBlock(b1)
+	if !reflect.DeepEqual(bl.PreviousBlock().Hash(), a1.Hash()) {
+		t.Fatal("Tip moved to a branch with equal work")
+	}
+
+	b2 := newTestBlock(minerKp, &b1)
+	bl.AddBlock(b2)
+
+	if len(bl.BlockSlice) != 3 || !reflect.DeepEqual(bl.PreviousBlock().Hash(), b2.Hash()) {
+		t.Fatal("Chain did not reorganize to the branch with most work")
+	}
+
+	if !bl.Mempool.Has(tr2.Hash()) || bl.Mempool.Has(tr3.Hash()) || !bl.CurrentBlock.TransactionSlice.Exists(*tr2) {
+		t.Error("Orphaned transactions not returned to the mempool")
+	}
+
+	if !reflect.DeepEqual(bl.CurrentBlock.PrevBlock, b2.Hash()) {
+		t.Error("New block template doesn't build on the new tip")
+	}
+
+	// The coinbase of the rolled back block doesn't come back
+	if bl.Mempool.Has(a1.Coinbase().Hash()) || bl.Mempool.Len() != 1 {
+		t.Error("Coinbase of a rolled back block returned to the mempool")
+	}
+	coinbases := 0
+	for _, tr := range *bl.CurrentBlock.TransactionSlice {
+		if tr.IsCoinbase() {
+			coinbases++
+		}
+	}
+	if coinbases != 1 || bl.CurrentBlock.Coinbase() == nil {
+		t.Error("Block template has", coinbases, "coinbases")
+	}
+	if err := bl.Mempool.Add(*a1.Coinbase()); err != ErrMempoolCoinbase {
+		t.Error("Coinbase added to the mempool", err)
+	}
+}
+
+func TestGenesisPinning(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	genesis, other := newTestBlock(kp, nil), newTestBlock(kp, nil, newTestTransaction(kp))
+
+	bl := newTestNode(kp).Blockchain
+	if err := bl.AddBlock(genesis); err != nil {
+		t.Fatal(err)
+	}
+	if err := bl.AddBlock(other); err != ErrSecondGenesis {
+		t.Error("Second genesis block added", err)
+	}
+
+	params := DefaultConsensusParams()
+	copy(params.GenesisHash[:], genesis.Hash())
+	node, _ := NewNode(NodeOptions{Keypair: kp, Consensus: params})
+	if err := node.Blockchain.AddBlock(other); err != ErrUnknownGenesis {
+		t.Error("Genesis block of another network added", err)
+	}
+	if err := node.Blockchain.AddBlock(genesis); err != nil {
+		t.Error("Genesis block of the network rejected", err)
+	}
+}
+
+func TestStaleBranch(t *testing.T) {
+
+	tree := NewBlockTree()
+	params := DefaultConsensusParams()
+
+	block := func(parent []byte, nonce uint32) Block {
+		b := NewBlock(parent)
+		b.Nonce = nonce
+		return b
+	}
+
+	genesis := block(nil, 0)
+	tree.Insert(genesis)
+	prev := genesis.Hash()
+	for i := 0; i < MAX_BRANCH_LAG+2; i++ {
+		b := block(prev, 0)
+		b.Timestamp = uint32(i)
+		tree.Insert(b)
+		prev = b.Hash()
+	}
+
+	if err := tree.CheckBranch(block(genesis.Hash(), 1), tree.Genesis, params); err != ErrStaleBranch {
+		t.Error("Branch far behind the tip accepted", err)
+	}
+	if err := tree.CheckBranch(block(tree.Tip.PrevBlock, 1), tree.Tip.Parent, params); err != nil {
+		t.Error("Branch next to the tip rejected", err)
+	}
+}
+
+func TestMinerStopsWithBlockQueued(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	node := newTestNode(kp)
+
+	// Nothing takes from the blocks queue, the miner is left holding the block it found
+	ctx, cancel := context.WithCancel(context.Background())
+	block := newTestBlock(kp, nil, newTestTransaction(kp))
+	block.Bits = BLOCK_POW_LIMIT_BITS
+	node.Blockchain.GenerateBlocks(ctx) <- block
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	done := make(chan bool)
+	go func() {
+		node.routines.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Miner didn't stop with its block queued")
+	}
+}
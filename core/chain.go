@@ -0,0 +1,169 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+)
+
+var (
+	ErrOrphanBlock    = errors.New("Block parent is unknown")
+	ErrSecondGenesis  = errors.New("Chain already has a different genesis block")
+	ErrUnknownGenesis = errors.New("Genesis block isn't the one of the network")
+	ErrStaleBranch    = errors.New("Block branch is too far behind the tip")
+)
+
+// Every block we know about, including the ones in competing branches.
+// The tip is the block with the most cumulative work behind it. All of them descend from a single
+// genesis block.
+type BlockTree struct {
+	nodes   map[string]*BlockNode
+	Genesis *BlockNode
+	Tip     *BlockNode
+}
+
+type BlockNode struct {
+	Block
+	Hash   []byte
+	Parent *BlockNode
+	Height int
+	Work   *big.Int
+}
+
+func NewBlockTree() *BlockTree {
+
+	return &BlockTree{nodes: map[string]*BlockNode{}}
+}
+
+func (t *BlockTree) Has(hash []byte) bool {
+
+	return t.nodes[string(hash)] != nil
+}
+
+func (t *BlockTree) Get(hash []byte) *BlockNode {
+
+	return t.nodes[string(hash)]
+}
+
+func (t *BlockTree) Len() int {
+
+	return len(t.nodes)
+}
+
+// Adds a block whose parent is already in the tree and moves the tip if the new branch has more work.
+// On equal work the tip we saw first is kept.
+func (t *BlockTree) Insert(b Block) (*BlockNode, error) {
+
+	hash := b.Hash()
+	if n := t.nodes[string(hash)]; n != nil {
+		return n, nil
+	}
+
+	n := &BlockNode{Block: b, Hash: hash, Work: BlockWork(b)}
+
+	if b.IsGenesis() {
+
+		if t.Genesis != nil {
+			return nil, ErrSecondGenesis
+		}
+		t.Genesis = n
+	} else {
+
+		parent := t.nodes[string(b.PrevBlock)]
+		if parent == nil {
+			return nil, ErrOrphanBlock
+		}
+
+		n.Parent = parent
+		n.Height = parent.Height + 1
+		n.Work.Add(n.Work, parent.Work)
+	}
+
+	t.nodes[string(hash)] = n
+
+	if t.Tip == nil || n.Work.Cmp(t.Tip.Work) > 0 {
+		t.Tip = n
+	}
+
+	return n, nil
+}
+
+// Blocks from genesis up to the tip
+func (t *BlockTree) MainChain() BlockSlice {
+
+	if t.Tip == nil {
+		return BlockSlice{}
+	}
+
+	bs := make(BlockSlice, t.Tip.Height+1)
+	for n := t.Tip; n != nil; n = n.Parent {
+		bs[n.Height] = n.Block
+	}
+
+	return bs
+}
+
+// Checks that b can go on top of parent: a genesis block must be the one of params, if any, and other
+// blocks can't start or extend a branch whose work is more than MAX_BRANCH_LAG blocks behind the tip.
+// Those branches can't take over without redoing all that work, they would only fill the store.
+func (t *BlockTree) CheckBranch(b Block, parent *BlockNode, params ConsensusParams) error {
+
+	if b.IsGenesis() {
+
+		if params.GenesisHash != ([32]byte{}) && !bytes.Equal(b.Hash(), params.GenesisHash[:]) {
+			return ErrUnknownGenesis
+		}
+		if t.Genesis != nil {
+			return ErrSecondGenesis
+		}
+		return nil
+	}
+
+	if parent == nil || t.Tip == nil {
+		return nil
+	}
+
+	work := new(big.Int).Add(parent.Work, BlockWork(b))
+	behind := new(big.Int).Sub(t.Tip.Work, work)
+	if behind.Cmp(new(big.Int).Mul(BlockWork(t.Tip.Block), big.NewInt(MAX_BRANCH_LAG))) > 0 {
+		return ErrStaleBranch
+	}
+
+	return nil
+}
+
+// Last common ancestor of two nodes, nil if they come from different genesis blocks.
+func FindFork(a, b *BlockNode) *BlockNode {
+
+	for a != nil && b != nil && a != b {
+
+		if a.Height >= b.Height {
+			a = a.Parent
+		} else {
+			b = b.Parent
+		}
+	}
+
+	if a == nil || b == nil {
+		return nil
+	}
+
+	return a
+}
+
+func (b *Block) IsGenesis() bool {
+
+	for _, c := range b.PrevBlock {
+		if c != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Expected number of hashes needed to find the block
+func BlockWork(b Block) *big.Int {
+
+	return WorkForTarget(b.Bits)
+}
@@ -0,0 +1,96 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"math"
+)
+
+var (
+	ErrBadCoinbase = errors.New("Block doesn't start with a valid coinbase")
+	ErrFeeOverflow = errors.New("Transaction fees overflow")
+)
+
+// First transaction of every block, it pays the block subsidy and the fees to the block origin.
+// It has no sender or signature and its sequence is the block height, so coinbases are never repeated.
+func NewCoinbase(origin []byte, height int, amount uint64) *Transaction {
+
+	t := NewTransaction(nil, origin, nil)
+	t.Header.Amount = amount
+	t.Header.Sequence = uint64(height)
+
+	return t
+}
+
+func (t *Transaction) IsCoinbase() bool {
+
+	return len(t.Header.From) == 0
+}
+
+// Coinbase of the block, nil if it doesn't start with one
+func (b *Block) Coinbase() *Transaction {
+
+	if b.TransactionSlice == nil || len(*b.TransactionSlice) == 0 || !(*b.TransactionSlice)[0].IsCoinbase() {
+		return nil
+	}
+
+	return &(*b.TransactionSlice)[0]
+}
+
+// BlockReward halves every HalvingInterval blocks
+func BlockSubsidy(height int, params ConsensusParams) uint64 {
+
+	halvings := 0
+	if params.HalvingInterval > 0 {
+		halvings = height / params.HalvingInterval
+	}
+	if halvings >= 64 {
+		return 0
+	}
+
+	return params.BlockReward >> uint(halvings)
+}
+
+// Sum of the fees of ts
+func TransactionFees(ts TransactionSlice) (uint64, error) {
+
+	fees := uint64(0)
+	for _, t := range ts {
+		if fees > math.MaxUint64-t.Header.Fee {
+			return 0, ErrFeeOverflow
+		}
+		fees += t.Header.Fee
+	}
+
+	return fees, nil
+}
+
+// Exactly one coinbase, in position zero, paying the subsidy of the height it claims and the fees
+// to the origin. The height itself is checked when the block is added to the chain.
+func (b *Block) verifyCoinbase(params ConsensusParams) error {
+
+	c := b.Coinbase()
+	if c == nil || c.Header.Sequence > math.MaxInt32 {
+		return ErrBadCoinbase
+	}
+	for _, t := range (*b.TransactionSlice)[1:] {
+		if t.IsCoinbase() {
+			return ErrBadCoinbase
+		}
+	}
+
+	fees, err := TransactionFees((*b.TransactionSlice)[1:])
+	if err != nil {
+		return err
+	}
+	subsidy := BlockSubsidy(int(c.Header.Sequence), params)
+	if fees > math.MaxUint64-subsidy {
+		return ErrFeeOverflow
+	}
+
+	if !bytes.Equal(c.Header.To, b.Origin) || c.Header.Amount != subsidy+fees {
+		return ErrBadCoinbase
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestBlockSubsidy(t *testing.T) {
+
+	params := DefaultConsensusParams()
+	params.HalvingInterval = 10
+
+	for _, c := range []struct {
+		height int
+		amount uint64
+	}{{0, BLOCK_REWARD}, {9, BLOCK_REWARD}, {10, BLOCK_REWARD / 2}, {25, BLOCK_REWARD / 4}, {64 * 10, 0}} {
+
+		if a := BlockSubsidy(c.height, params); a != c.amount {
+			t.Error("Subsidy at height", c.height, "is", a, "expected", c.amount)
+		}
+	}
+}
+
+func TestVerifyCoinbase(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	params := DefaultConsensusParams()
+
+	mine := func(b *Block) *Block {
+		b.MerkelRoot = b.GenerateMerkelRoot()
+		b.Nonce = b.GenerateNonce()
+		b.Signature = b.Sign(kp)
+		return b
+	}
+
+	genesis := newTestBlock(kp, nil, newTestTransaction(kp))
+	mine(&genesis)
+	if err := genesis.VerifyBlock(params); err != nil {
+		t.Fatal("Valid block fails verification", err)
+	}
+
+	b := newTestBlock(kp, &genesis)
+	(*b.TransactionSlice)[0].Header.Amount++
+	if mine(&b).VerifyBlock(params) != ErrBadCoinbase {
+		t.Error("Coinbase paying too much passes")
+	}
+
+	b = newTestBlock(kp, &genesis)
+	(*b.TransactionSlice)[0].Header.To = GenerateNewKeypair().Public
+	if mine(&b).VerifyBlock(params) != ErrBadCoinbase {
+		t.Error("Coinbase paying someone else than the origin passes")
+	}
+
+	b = newTestBlock(kp, &genesis)
+	*b.TransactionSlice = append(*b.TransactionSlice, (*b.TransactionSlice)[0])
+	if mine(&b).VerifyBlock(params) != ErrBadCoinbase {
+		t.Error("Block with two coinbases passes")
+	}
+
+	b = newTestBlock(kp, &genesis, newTestTransaction(kp))
+	*b.TransactionSlice = (*b.TransactionSlice)[1:]
+	if mine(&b).VerifyBlock(params) != ErrBadCoinbase {
+		t.Error("Block without coinbase passes")
+	}
+
+	// The claimed height is checked against the chain
+	bl := newTestNode(kp).Blockchain
+	if err := bl.AddBlock(genesis); err != nil {
+		t.Fatal(err)
+	}
+	b = newTestBlock(kp, &genesis)
+	(*b.TransactionSlice)[0] = *NewCoinbase(kp.Public, 5, BlockSubsidy(5, params))
+	if err := bl.AddBlock(*mine(&b)); err != ErrBadCoinbase {
+		t.Error("Coinbase with the wrong height added", err)
+	}
+}
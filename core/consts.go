@@ -1,15 +1,34 @@
 package core
 
-import _ "fmt"
+import (
+	_ "fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
 
 const (
 	BLOCKCHAIN_PORT      = "9119"
 	MAX_NODE_CONNECTIONS = 400
 
+	RPC_PORT = "9120"
+	// The RPC server can submit transactions for the node, it only listens on loopback by default
+	RPC_ADDRESS = "127.0.0.1:" + RPC_PORT
+
 	NETWORK_KEY_SIZE = 80
 
-	TRANSACTION_HEADER_SIZE = NETWORK_KEY_SIZE /* from key */ + NETWORK_KEY_SIZE /* to key */ + 4 /* int32 timestamp */ + 32 /* sha256 payload hash */ + 4 /* int32 payload length */ + 4 /* int32 nonce */
-	BLOCK_HEADER_SIZE       = NETWORK_KEY_SIZE /* origin key */ + 4 /* int32 timestamp */ + 32 /* prev block hash */ + 32 /* merkel tree hash */ + 4                                      /* int32 nonce */
+	TRANSACTION_HEADER_SIZE = NETWORK_KEY_SIZE /* from key */ + NETWORK_KEY_SIZE /* to key */ + 8 /* uint64 amount */ + 8 /* uint64 sequence */ + 8 /* uint64 fee */ + 4 /* int32 timestamp */ + 32 /* sha256 payload hash */ + 4 /* int32 payload length */ + 4 /* int32 nonce */
+	BLOCK_HEADER_SIZE       = 4 /* uint32 version */ + NETWORK_KEY_SIZE /* origin key */ + 4 /* int32 timestamp */ + 32 /* prev block hash */ + 32 /* merkel tree hash */ + 4 /* uint32 compact target */ + 4                                                    /* int32 nonce */
+
+	TRANSACTION_PAYLOAD_LENGTH_OFFSET = NETWORK_KEY_SIZE + NETWORK_KEY_SIZE + 8 + 8 + 8 + 4 + 32
+
+	// Only bumped when a released encoding changes, blocks of every released version must still decode
+	BLOCK_ENCODING_VERSION = 1
+
+	// Header versions, they select the merkel tree of the block
+	BLOCK_VERSION_LEGACY_MERKLE = 1
+	BLOCK_VERSION_TAGGED_MERKLE = 2
+	BLOCK_VERSION               = BLOCK_VERSION_TAGGED_MERKLE
 
 	KEY_POW_COMPLEXITY      = 0
 	TEST_KEY_POW_COMPLEXITY = 0
@@ -17,8 +36,19 @@ const (
 	TRANSACTION_POW_COMPLEXITY      = 1
 	TEST_TRANSACTION_POW_COMPLEXITY = 1
 
-	BLOCK_POW_COMPLEXITY      = 2
-	TEST_BLOCK_POW_COMPLEXITY = 2
+	// Easiest block target, hashes starting with 2 zero bytes
+	BLOCK_POW_LIMIT_BITS  = 0x1f00ffff
+	BLOCK_INTERVAL        = time.Minute
+	BLOCK_RETARGET_WINDOW = 20
+	// A block timestamp can't go before the median of this many previous blocks, nor further than
+	// BLOCK_MAX_FUTURE_TIME from our clock
+	BLOCK_MEDIAN_TIME_BLOCKS = 11
+	BLOCK_MAX_FUTURE_TIME    = 5 * time.Minute
+
+	// Amounts are in units of 1/COIN
+	COIN                   = 100000000
+	BLOCK_REWARD           = 50 * COIN
+	BLOCK_HALVING_INTERVAL = 210000
 
 	KEY_SIZE = 28
 
@@ -27,6 +57,77 @@ const (
 
 	MESSAGE_TYPE_SIZE    = 1
 	MESSAGE_OPTIONS_SIZE = 4
+
+	MESSAGE_MAGIC             = 0xB10C4A1E
+	MESSAGE_CHECKSUM_SIZE     = 4
+	MESSAGE_FRAME_HEADER_SIZE = 4 /* magic */ + MESSAGE_TYPE_SIZE + MESSAGE_OPTIONS_SIZE + 4 /* uint32 payload length */ + MESSAGE_CHECKSUM_SIZE
+	// Only the version and verack messages are read before the handshake is done
+	MAX_HANDSHAKE_FRAME_SIZE = 1024
+
+	PROTOCOL_VERSION     = 1
+	MIN_PROTOCOL_VERSION = 1
+	USER_AGENT           = "/blockchain:0.1.0/"
+	HANDSHAKE_TIMEOUT    = 30 * time.Second
+
+	TRANSPORT_KEY_TAG              = "Blockchain transport key"
+	TRANSPORT_CERTIFICATE_VALIDITY = 365 * 24 * time.Hour
+
+	MAX_NODES_PER_MESSAGE  = 1000
+	MAX_ADDRESS_BOOK_SIZE  = 5000
+	ADDRESS_BOOK_EXPIRY    = 3 * time.Hour
+	PEER_EXCHANGE_INTERVAL = 2 * time.Minute
+
+	PEER_DIAL_TIMEOUT        = 5 * time.Second
+	PEER_WRITE_TIMEOUT       = 30 * time.Second
+	PEER_RECONNECT_MIN_DELAY = time.Second
+	PEER_RECONNECT_MAX_DELAY = 5 * time.Minute
+
+	MAX_HEADERS_PER_MESSAGE = 2000
+	MAX_BLOCKS_PER_REQUEST  = 16
+	MAX_ORPHAN_BLOCKS       = 1000
+	// Blocks of branches further behind the tip than this many blocks of its work are rejected
+	MAX_BRANCH_LAG = 100
+	// Orphans only have the minimum proof of work checked, so their bytes are capped in total and per peer
+	MAX_ORPHAN_POOL_SIZE = 16 * 1024 * 1024
+	MAX_ORPHAN_PEER_SIZE = 4 * 1024 * 1024
+
+	SYNC_INTERVAL                 = 30 * time.Second
+	SYNC_REQUEST_TIMEOUT          = 60 * time.Second
+	SYNC_MISSING_REQUEST_INTERVAL = 5 * time.Second
+
+	MEMPOOL_MAX_TRANSACTIONS = 50000
+	MEMPOOL_MAX_SIZE         = 64 * 1024 * 1024
+	MEMPOOL_MAX_PER_SENDER   = 100
+	MEMPOOL_EXPIRY           = 24 * time.Hour
+	MEMPOOL_EXPIRY_INTERVAL  = 10 * time.Minute
+	MEMPOOL_TIMESTAMP_DRIFT  = 2 * time.Minute
+
+	MAX_BLOCK_SIZE               = 1024 * 1024
+	MAX_BLOCK_TRANSACTIONS       = 4096
+	MAX_TRANSACTION_PAYLOAD_SIZE = 64 * 1024
+	FEE_ESTIMATION_BLOCKS        = 10
+	MAX_MERKLE_PROOF_STEPS       = 64
+
+	VERIFIED_TRANSACTIONS_CACHE_SIZE = 100000
+
+	RPC_MAX_REQUEST_SIZE    = 8 * 1024 * 1024
+	RPC_READ_HEADER_TIMEOUT = 5 * time.Second
+	RPC_READ_TIMEOUT        = 30 * time.Second
+	RPC_WRITE_TIMEOUT       = 30 * time.Second
+	RPC_IDLE_TIMEOUT        = 2 * time.Minute
+
+	BLOCK_STORE_SEGMENT_SIZE       = 64 * 1024 * 1024
+	BLOCK_STORE_RECORD_HEADER_SIZE = 4 /* uint32 length */ + 4 /* crc32 */
+	BLOCK_STORE_SEGMENT_EXTENSION  = ".blk"
+
+	KEYSTORE_SCRYPT_N       = 1 << 18
+	KEYSTORE_SCRYPT_R       = 8
+	KEYSTORE_SCRYPT_P       = 1
+	KEYSTORE_FILE_EXTENSION = ".json"
+
+	HD_MASTER_KEY          = "Blockchain seed"
+	HARDENED_KEY_START     = 0x80000000
+	MNEMONIC_PBKDF2_ROUNDS = 2048
 )
 
 const (
@@ -38,6 +139,15 @@ const (
 
 	MESSAGE_GET_BLOCK
 	MESSAGE_SEND_BLOCK
+
+	MESSAGE_GET_HEADERS
+	MESSAGE_SEND_HEADERS
+
+	MESSAGE_GET_MERKLE_PROOFS
+	MESSAGE_SEND_MERKLE_PROOFS
+
+	MESSAGE_VERSION
+	MESSAGE_VERACK
 )
 
 func SEED_NODES() []string {
@@ -49,3 +159,13 @@ func SEED_NODES() []string {
 
 	return nodes
 }
+
+func BLOCK_STORE_DIRECTORY() string {
+
+	return filepath.Join(os.Getenv("HOME"), ".blockchain", "blocks")
+}
+
+func KEYSTORE_DIRECTORY() string {
+
+	return filepath.Join(os.Getenv("HOME"), ".blockchain", "keystore")
+}
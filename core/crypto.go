@@ -20,10 +20,23 @@ func GenerateNewKeypair() *Keypair {
 
 	pk, _ := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
 
-	b := bigJoin(KEY_SIZE, pk.PublicKey.X, pk.PublicKey.Y)
+	return keypairFromKey(pk.D, pk.PublicKey.X, pk.PublicKey.Y)
+}
+
+// Keypair of the private key d, used for keys derived from a seed
+func KeypairFromPrivate(d *big.Int) *Keypair {
+
+	x, y := elliptic.P224().ScalarBaseMult(d.Bytes())
+
+	return keypairFromKey(d, x, y)
+}
+
+func keypairFromKey(d, x, y *big.Int) *Keypair {
+
+	b := bigJoin(KEY_SIZE, x, y)
 
 	public := base58.EncodeBig([]byte{}, b)
-	private := base58.EncodeBig([]byte{}, pk.D)
+	private := base58.EncodeBig([]byte{}, d)
 
 	kp := Keypair{Public: public, Private: private}
 
@@ -64,6 +77,22 @@ func SignatureVerify(publicKey, sig, hash []byte) bool {
 	return ecdsa.Verify(&pub, hash, r, s)
 }
 
+// Public keys are the base58 encoding of a point of the curve
+func ValidPublicKey(key []byte) bool {
+
+	if len(key) == 0 || len(key) > NETWORK_KEY_SIZE {
+		return false
+	}
+
+	b, err := base58.DecodeToBig(key)
+	if err != nil {
+		return false
+	}
+	publ := splitBig(b, 2)
+
+	return elliptic.P224().IsOnCurve(publ[0], publ[1])
+}
+
 func bigJoin(expectedLen int, bigs ...*big.Int) *big.Int {
 
 	bs := []byte{}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+	"time"
+)
+
+var (
+	ErrBadDifficulty   = errors.New("Block target doesn't follow the difficulty rule")
+	ErrBadBlockVersion = errors.New("Block version isn't allowed at its height")
+	ErrBlockTooOld     = errors.New("Block timestamp is before the median time of its previous blocks")
+	ErrBlockTooNew     = errors.New("Block timestamp is too far in the future")
+
+	ErrBlockIntervalTooShort = errors.New("Block interval is shorter than a second, the resolution of block timestamps")
+)
+
+// Rules every node must agree on to validate the same chain
+type ConsensusParams struct {
+	// Easiest target allowed, it is also the target of the first RetargetWindow blocks
+	PowLimitBits uint32
+	// Time we aim to have between blocks, at least a second
+	BlockInterval time.Duration
+	// Number of blocks whose timestamps are used to compute the next target
+	RetargetWindow int
+	// Blocks from this height on must use the tagged merkel tree. Zero keeps BLOCK_VERSION_LEGACY_MERKLE
+	// blocks valid at any height, so chains started before the tagged tree still verify
+	TaggedMerkleHeight int
+
+	// Subsidy the coinbase of the first blocks pays to their origin, it halves every HalvingInterval blocks
+	BlockReward     uint64
+	HalvingInterval int
+
+	// Size limits, in encoded bytes for blocks
+	MaxBlockSize         int
+	MaxBlockTransactions int
+	MaxPayloadSize       int
+
+	// Hash of the only genesis block accepted, the first one we get when zero
+	GenesisHash [32]byte
+
+	// Keep account balances: transactions move amounts and need the next sequence number of their sender
+	Ledger bool
+}
+
+func DefaultConsensusParams() ConsensusParams {
+
+	return ConsensusParams{
+		PowLimitBits:    BLOCK_POW_LIMIT_BITS,
+		BlockInterval:   BLOCK_INTERVAL,
+		RetargetWindow:  BLOCK_RETARGET_WINDOW,
+		BlockReward:     BLOCK_REWARD,
+		HalvingInterval: BLOCK_HALVING_INTERVAL,
+
+		MaxBlockSize:         MAX_BLOCK_SIZE,
+		MaxBlockTransactions: MAX_BLOCK_TRANSACTIONS,
+		MaxPayloadSize:       MAX_TRANSACTION_PAYLOAD_SIZE,
+	}
+}
+
+func CheckBlockVersion(version uint32, height int, params ConsensusParams) error {
+
+	if version > BLOCK_VERSION || version < BLOCK_VERSION_LEGACY_MERKLE {
+		return ErrBadBlockVersion
+	}
+	if version == BLOCK_VERSION_LEGACY_MERKLE && params.TaggedMerkleHeight > 0 && height >= params.TaggedMerkleHeight {
+		return ErrBadBlockVersion
+	}
+
+	return nil
+}
+
+// Checks the rules that depend on where the block goes: the target and version for its height
+// and a timestamp after the median time of its previous blocks and not too far after now.
+// Block.VerifyBlock checks the rest, this can only run once the parent is known.
+func (b *Block) VerifyContext(parent *BlockNode, params ConsensusParams, now time.Time) error {
+
+	if b.Bits != NextBlockBits(parent, params) {
+		return ErrBadDifficulty
+	}
+
+	height := 0
+	if parent != nil {
+		height = parent.Height + 1
+	}
+	if err := CheckBlockVersion(b.Version, height, params); err != nil {
+		return err
+	}
+
+	if parent != nil && b.Timestamp < MedianTimePast(parent) {
+		return ErrBlockTooOld
+	}
+	if time.Unix(int64(b.Timestamp), 0).After(now.Add(BLOCK_MAX_FUTURE_TIME)) {
+		return ErrBlockTooNew
+	}
+
+	return nil
+}
+
+// Median timestamp of the last BLOCK_MEDIAN_TIME_BLOCKS blocks up to parent
+func MedianTimePast(parent *BlockNode) uint32 {
+
+	timestamps := []uint32{}
+	for n := parent; n != nil && len(timestamps) < BLOCK_MEDIAN_TIME_BLOCKS; n = n.Parent {
+		timestamps = append(timestamps, n.Timestamp)
+	}
+	if len(timestamps) == 0 {
+		return 0
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	return timestamps[len(timestamps)/2]
+}
+
+// Target for the block that goes on top of parent.
+// The average target of the last RetargetWindow blocks is scaled by how long they took compared to
+// the expected time, clamped to a factor of 4 each way and never easier than PowLimitBits.
+// Starting from the average instead of the parent target keeps every block from compounding the
+// correction of the previous one.
+func NextBlockBits(parent *BlockNode, params ConsensusParams) uint32 {
+
+	if parent == nil || params.RetargetWindow <= 0 || params.BlockInterval <= 0 || parent.Height < params.RetargetWindow {
+		return params.PowLimitBits
+	}
+
+	sum := new(big.Int)
+	first := parent
+	for i := 0; i < params.RetargetWindow; i++ {
+		sum.Add(sum, CompactToTarget(first.Bits))
+		first = first.Parent
+	}
+
+	// In nanoseconds, so an interval that isn't a whole number of seconds isn't rounded
+	expected := int64(params.RetargetWindow) * int64(params.BlockInterval)
+	actual := (int64(parent.Timestamp) - int64(first.Timestamp)) * int64(time.Second)
+
+	if actual < expected/4 {
+		actual = expected / 4
+	}
+	if actual > expected*4 {
+		actual = expected * 4
+	}
+
+	target := sum.Div(sum, big.NewInt(int64(params.RetargetWindow)))
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+
+	if limit := CompactToTarget(params.PowLimitBits); target.Cmp(limit) > 0 {
+		target = limit
+	}
+
+	return TargetToCompact(target)
+}
@@ -0,0 +1,130 @@
+package core
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newTestBlockNodes(params ConsensusParams, n int, interval time.Duration) *BlockNode {
+
+	var tip *BlockNode
+	for i := 0; i < n; i++ {
+
+		b := NewBlock(nil)
+		b.Timestamp = uint32(i) * uint32(interval/time.Second)
+		b.Bits = NextBlockBits(tip, params)
+
+		node := &BlockNode{Block: b, Parent: tip}
+		if tip != nil {
+			node.Height = tip.Height + 1
+		}
+		tip = node
+	}
+
+	return tip
+}
+
+func TestNextBlockBits(t *testing.T) {
+
+	params := ConsensusParams{PowLimitBits: 0x1e00ffff, BlockInterval: time.Minute, RetargetWindow: 10}
+
+	if NextBlockBits(nil, params) != params.PowLimitBits || NextBlockBits(newTestBlockNodes(params, 5, time.Second), params) != params.PowLimitBits {
+		t.Error("Blocks before the first window should use the limit")
+	}
+
+	// Blocks on schedule keep the target
+	if bits := NextBlockBits(newTestBlockNodes(params, 11, time.Minute), params); bits != params.PowLimitBits {
+		t.Errorf("Target changed on schedule: %x", bits)
+	}
+
+	// Fast blocks make it harder, at most 4 times per window
+	fast := CompactToTarget(NextBlockBits(newTestBlockNodes(params, 11, time.Second), params))
+	limit := CompactToTarget(params.PowLimitBits)
+	if fast.Cmp(limit) >= 0 || fast.Mul(fast, big.NewInt(4)).Cmp(limit) < 0 {
+		t.Error("Fast blocks should make the target up to 4 times harder", fast)
+	}
+
+	// Slow blocks can't go easier than the limit
+	if bits := NextBlockBits(newTestBlockNodes(params, 11, time.Hour), params); bits != params.PowLimitBits {
+		t.Errorf("Target went over the limit: %x", bits)
+	}
+
+	// Every block starts from the average of the window, not from the correction of the previous one,
+	// which would make it 4 times harder again
+	fast = CompactToTarget(NextBlockBits(newTestBlockNodes(params, 11, time.Second), params))
+	next := CompactToTarget(NextBlockBits(newTestBlockNodes(params, 12, time.Second), params))
+	if next.Mul(next, big.NewInt(4)).Cmp(fast) <= 0 {
+		t.Error("Corrections compound block after block", next)
+	}
+
+	// Sub-second intervals can't be measured with block timestamps, but don't break the rule
+	params.BlockInterval = 500 * time.Millisecond
+	if bits := NextBlockBits(newTestBlockNodes(params, 11, 0), params); CompactToTarget(bits).Cmp(limit) >= 0 {
+		t.Errorf("Blocks with the same timestamp should make the target harder: %x", bits)
+	}
+	params.BlockInterval = 0
+	if bits := NextBlockBits(newTestBlockNodes(params, 11, time.Second), params); bits != params.PowLimitBits {
+		t.Errorf("Target without a block interval: %x", bits)
+	}
+	if _, err := NewNode(NodeOptions{Keypair: GenerateNewKeypair(), Consensus: params}); err != ErrBlockIntervalTooShort {
+		t.Error("Node with a block interval under a second created", err)
+	}
+}
+
+func TestVerifyContext(t *testing.T) {
+
+	params := ConsensusParams{PowLimitBits: 0x1e00ffff, BlockInterval: time.Minute, RetargetWindow: 10}
+	parent := newTestBlockNodes(params, 11, time.Minute)
+	now := time.Unix(int64(parent.Timestamp), 0)
+
+	b := NewBlock(parent.Hash)
+	b.Bits = NextBlockBits(parent, params)
+	b.Timestamp = MedianTimePast(parent)
+	if err := b.VerifyContext(parent, params, now); err != nil {
+		t.Error("Block at the median time rejected", err)
+	}
+
+	b.Timestamp--
+	if err := b.VerifyContext(parent, params, now); err != ErrBlockTooOld {
+		t.Error("Block before the median time accepted", err)
+	}
+
+	b.Timestamp = uint32(now.Add(2 * BLOCK_MAX_FUTURE_TIME).Unix())
+	if err := b.VerifyContext(parent, params, now); err != ErrBlockTooNew {
+		t.Error("Block from the future accepted", err)
+	}
+}
+
+func TestAddBlockChecksDifficulty(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	bl := newTestNode(kp).Blockchain
+
+	b := newTestBlock(kp, nil, newTestTransaction(kp))
+	b.Bits = 0x1e00ffff
+	b.Signature = b.Sign(kp)
+
+	if err := bl.AddBlock(b); err != ErrBadDifficulty {
+		t.Error("Block with the wrong target added", err)
+	}
+}
+
+func TestCheckBlockVersion(t *testing.T) {
+
+	params := DefaultConsensusParams()
+	params.TaggedMerkleHeight = 10
+
+	if CheckBlockVersion(BLOCK_VERSION_LEGACY_MERKLE, 9, params) != nil || CheckBlockVersion(BLOCK_VERSION, 9, params) != nil {
+		t.Error("Versions before the activation height rejected")
+	}
+	if CheckBlockVersion(BLOCK_VERSION_LEGACY_MERKLE, 10, params) != ErrBadBlockVersion {
+		t.Error("Legacy merkel tree accepted after the activation height")
+	}
+	if CheckBlockVersion(BLOCK_VERSION+1, 0, params) != ErrBadBlockVersion {
+		t.Error("Unknown version accepted")
+	}
+	if CheckBlockVersion(BLOCK_VERSION_LEGACY_MERKLE, 1000, DefaultConsensusParams()) != nil {
+		t.Error("Legacy merkel tree rejected without an activation height")
+	}
+}
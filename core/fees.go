@@ -0,0 +1,51 @@
+package core
+
+import (
+	"math"
+	"sort"
+)
+
+// Fee per byte that got transactions into the last blocks of the main chain: the median of the
+// lowest fee rate each block included. Blocks without transactions besides their coinbase don't count,
+// and it is 0 when there are none.
+func (bl *Blockchain) EstimateFeeRate(blocks int) float64 {
+
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	rates := []float64{}
+	for i := len(bl.BlockSlice) - 1; i >= 0 && i >= len(bl.BlockSlice)-blocks; i-- {
+
+		ts := *bl.BlockSlice[i].TransactionSlice
+		if len(ts) < 2 {
+			continue
+		}
+
+		lowest := math.Inf(1)
+		for _, t := range ts[1:] {
+			lowest = math.Min(lowest, t.FeeRate())
+		}
+		rates = append(rates, lowest)
+	}
+
+	if len(rates) == 0 {
+		return 0
+	}
+	sort.Float64s(rates)
+
+	return rates[len(rates)/2]
+}
+
+// Fee for a transaction with the given payload length at the rate of the last FEE_ESTIMATION_BLOCKS blocks
+func (node *Node) EstimateFee(payloadLength int) uint64 {
+
+	return FeeForPayload(node.Blockchain.EstimateFeeRate(FEE_ESTIMATION_BLOCKS), payloadLength)
+}
+
+// Fee paying rate per byte for a transaction with the given payload length, rounded up
+func FeeForPayload(rate float64, payloadLength int) uint64 {
+
+	size := TRANSACTION_HEADER_SIZE + NETWORK_KEY_SIZE + payloadLength
+
+	return uint64(math.Ceil(rate * float64(size)))
+}
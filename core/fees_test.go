@@ -0,0 +1,123 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestBlockTemplateFees(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	bl := newTestNode(kp).Blockchain
+	params := bl.node.options.Consensus
+
+	genesis := newTestBlock(kp, nil)
+	if err := bl.AddBlock(genesis); err != nil {
+		t.Fatal(err)
+	}
+	bl.Mempool.Add(*newTestTransaction(kp, withFee(10)))
+	bl.Mempool.Add(*newTestTransaction(kp, withFee(32)))
+
+	b := bl.NewBlockTemplate()
+	if b.Coinbase().Header.Amount != BlockSubsidy(1, params)+42 {
+		t.Error("Coinbase doesn't collect the fees", b.Coinbase().Header.Amount)
+	}
+
+	b.MerkelRoot = b.GenerateMerkelRoot()
+	b.Nonce = b.GenerateNonce()
+	b.Signature = b.Sign(kp)
+	if err := b.VerifyBlock(params); err != nil {
+		t.Error("Template with fees fails verification", err)
+	}
+
+	(*b.TransactionSlice)[1].Header.Fee++
+	if b.verifyCoinbase(params) != ErrBadCoinbase {
+		t.Error("Coinbase not matching the fees passes")
+	}
+}
+
+func TestLedgerFees(t *testing.T) {
+
+	alice, bob, miner := GenerateNewKeypair(), GenerateNewKeypair(), GenerateNewKeypair()
+	bl := newTestLedgerNode(alice).Blockchain
+
+	genesis := newTestBlock(alice, nil)
+	tr := newTestTransaction(alice, withTransfer(bob.Public, 10, 1), withFee(5))
+
+	b1 := newTestBlock(miner, &genesis, tr)
+	(*b1.TransactionSlice)[0].Header.Amount += 5
+	b1.MerkelRoot = b1.GenerateMerkelRoot()
+	b1.Signature = b1.Sign(miner)
+
+	for _, b := range []Block{genesis, b1} {
+		if err := bl.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if a := bl.Ledger.Account(alice.Public); a.Balance != BLOCK_REWARD-15 {
+		t.Error("Fee not taken from the sender", a)
+	}
+	if a := bl.Ledger.Account(miner.Public); a.Balance != BLOCK_REWARD+5 {
+		t.Error("Fee not paid to the miner", a)
+	}
+
+	over := newTestTransaction(alice, withTransfer(bob.Public, BLOCK_REWARD-15, 2), withFee(1))
+	if err := bl.checkPendingTransaction(*over); err != ErrInsufficientBalance {
+		t.Error("Transaction that can't pay its fee accepted", err)
+	}
+}
+
+func TestEstimateFeeRate(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	node := newTestNode(kp)
+	bl := node.Blockchain
+
+	if rate := bl.EstimateFeeRate(FEE_ESTIMATION_BLOCKS); rate != 0 {
+		t.Error("Estimate without blocks should be 0", rate)
+	}
+
+	var prev *Block
+	for _, fees := range [][]uint64{{100000, 50000}, {200000}, {}, {300000, 400000}} {
+
+		b := newTestBlock(kp, prev)
+		// Same size for every transaction, so their fee rates compare as their fees
+		for _, f := range fees {
+			*b.TransactionSlice = append(*b.TransactionSlice, *newTestTransaction(kp, withPayload("fee"), withFee(f)))
+		}
+		b.MerkelRoot = b.GenerateMerkelRoot()
+		b.Signature = b.Sign(kp)
+		if err := bl.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+		prev = &b
+	}
+
+	// Lowest fees of the blocks with transactions: 50000, 200000 and 300000
+	rate := bl.EstimateFeeRate(FEE_ESTIMATION_BLOCKS)
+	expected := (*bl.BlockSlice[1].TransactionSlice)[1].FeeRate()
+	if rate != expected {
+		t.Error("Estimate should be the median of the lowest rates", rate, expected)
+	}
+	if rate := bl.EstimateFeeRate(1); rate != (*bl.BlockSlice[3].TransactionSlice)[1].FeeRate() {
+		t.Error("Estimate should only look at the last block", rate)
+	}
+	if fee := node.EstimateFee(100); fee != FeeForPayload(rate, 100) || fee == 0 {
+		t.Error("Wrong fee estimate", fee)
+	}
+}
+
+func TestFeeWithoutLedger(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	options := newTestNode(kp).options
+	tr := newTestTransaction(kp, withFee(1<<63), withPow())
+
+	if err := tr.VerifyTransaction(options.TransactionPow, options.Consensus); err != ErrFeeWithoutLedger {
+		t.Error("Fee accepted without the ledger", err)
+	}
+	options.Consensus.Ledger = true
+	if err := tr.VerifyTransaction(options.TransactionPow, options.Consensus); err != nil {
+		t.Error("Fee rejected with the ledger", err)
+	}
+}
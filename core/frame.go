@@ -0,0 +1,136 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"reflect"
+	"sync"
+
+	"github.com/izqui/helpers"
+)
+
+// Messages travel over TCP as frames:
+//
+//	magic (4 bytes) | identifier (1 byte) | options (4 bytes) | payload length (4 bytes) | checksum (4 bytes) | payload
+//
+// The checksum is the first 4 bytes of sha256(payload).
+
+var (
+	ErrFrameMagic    = errors.New("Frame has wrong magic bytes")
+	ErrFrameTooLarge = errors.New("Frame exceeds max frame size")
+	ErrFrameChecksum = errors.New("Frame checksum mismatch")
+)
+
+// Largest message peers need to exchange under params: a block, the merkel proofs of all of its
+// transactions, a full headers message or a full addresses message.
+func MaxFrameSize(params ConsensusParams) uint32 {
+
+	// Transactions are the ones of the block, each goes with its length and its proof
+	steps := bits.Len(uint(params.MaxBlockTransactions))
+	proof := 32 + 4 + 1 + steps*(1+32)
+	size := 32 + 4 + params.MaxBlockSize + params.MaxBlockTransactions*(4+4+proof)
+
+	if headers := 4 + MAX_HEADERS_PER_MESSAGE*(BLOCK_HEADER_SIZE+NETWORK_KEY_SIZE); headers > size {
+		size = headers
+	}
+	if addresses := 4 + MAX_NODES_PER_MESSAGE*(4+1+255); addresses > size {
+		size = addresses
+	}
+
+	return uint32(size)
+}
+
+type MessageReader struct {
+	reader       *bufio.Reader
+	MaxFrameSize uint32
+}
+
+func NewMessageReader(r io.Reader, maxFrameSize uint32) *MessageReader {
+
+	return &MessageReader{bufio.NewReader(r), maxFrameSize}
+}
+
+// Blocks until a whole frame has been read. Any error leaves the stream in an unknown position,
+// so the caller should drop the connection.
+func (r *MessageReader) ReadMessage() (*Message, error) {
+
+	header := make([]byte, MESSAGE_FRAME_HEADER_SIZE)
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(header)
+
+	var magic, length uint32
+	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &magic)
+	if magic != MESSAGE_MAGIC {
+		return nil, ErrFrameMagic
+	}
+
+	m := new(Message)
+	m.Identifier = buf.Next(MESSAGE_TYPE_SIZE)[0]
+	m.Options = helpers.StripByte(buf.Next(MESSAGE_OPTIONS_SIZE), 0)
+
+	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &length)
+	if length > r.MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	checksum := buf.Next(MESSAGE_CHECKSUM_SIZE)
+
+	m.Data = make([]byte, length)
+	if _, err := io.ReadFull(r.reader, m.Data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if !reflect.DeepEqual(checksum, frameChecksum(m.Data)) {
+		return nil, ErrFrameChecksum
+	}
+
+	return m, nil
+}
+
+// Safe for concurrent use, frames from different goroutines are never interleaved.
+type MessageWriter struct {
+	writer       io.Writer
+	MaxFrameSize uint32
+
+	lock sync.Mutex
+}
+
+func NewMessageWriter(w io.Writer, maxFrameSize uint32) *MessageWriter {
+
+	return &MessageWriter{writer: w, MaxFrameSize: maxFrameSize}
+}
+
+func (w *MessageWriter) WriteMessage(m *Message) error {
+
+	if int64(len(m.Data)) > int64(w.MaxFrameSize) {
+		return ErrFrameTooLarge
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(MESSAGE_MAGIC))
+	buf.WriteByte(m.Identifier)
+	buf.Write(helpers.FitBytesInto(m.Options, MESSAGE_OPTIONS_SIZE))
+	binary.Write(buf, binary.LittleEndian, uint32(len(m.Data)))
+	buf.Write(frameChecksum(m.Data))
+	buf.Write(m.Data)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	_, err := w.writer.Write(buf.Bytes())
+	return err
+}
+
+func frameChecksum(data []byte) []byte {
+
+	return helpers.SHA256(data)[:MESSAGE_CHECKSUM_SIZE]
+}
@@ -0,0 +1,66 @@
+package core
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/izqui/helpers"
+)
+
+func TestFrameStreaming(t *testing.T) {
+
+	buf := new(bytes.Buffer)
+	w := NewMessageWriter(buf, MaxFrameSize(DefaultConsensusParams()))
+
+	messages := []*Message{
+		&Message{Identifier: MESSAGE_SEND_TRANSACTION, Options: []byte{1, 2, 3, 4}, Data: []byte(helpers.RandomString(helpers.RandomInt(1, 1024)))},
+		&Message{Identifier: MESSAGE_SEND_BLOCK, Options: []byte{5}, Data: []byte(helpers.RandomString(2 * 1024 * 1024))},
+		&Message{Identifier: MESSAGE_GET_NODES, Options: []byte{}, Data: []byte{}},
+	}
+
+	for _, m := range messages {
+		if err := w.WriteMessage(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewMessageReader(buf, MaxFrameSize(DefaultConsensusParams()))
+	for _, m := range messages {
+
+		read, err := r.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if read.Identifier != m.Identifier || !reflect.DeepEqual(read.Data, m.Data) || !bytes.Equal(read.Options, m.Options) {
+			t.Error("Read message differs from written message")
+		}
+	}
+}
+
+func TestFrameRejection(t *testing.T) {
+
+	m := &Message{Identifier: MESSAGE_SEND_BLOCK, Data: []byte(helpers.RandomString(1024))}
+
+	buf := new(bytes.Buffer)
+	NewMessageWriter(buf, MaxFrameSize(DefaultConsensusParams())).WriteMessage(m)
+	if _, err := NewMessageReader(bytes.NewBuffer(buf.Bytes()), 512).ReadMessage(); err != ErrFrameTooLarge {
+		t.Error("Oversized frame not rejected", err)
+	}
+
+	if err := NewMessageWriter(new(bytes.Buffer), 512).WriteMessage(m); err != ErrFrameTooLarge {
+		t.Error("Oversized frame written", err)
+	}
+
+	corrupt := buf.Bytes()
+	corrupt[len(corrupt)-1] ^= 0xff
+	if _, err := NewMessageReader(bytes.NewBuffer(corrupt), MaxFrameSize(DefaultConsensusParams())).ReadMessage(); err != ErrFrameChecksum {
+		t.Error("Corrupt frame not rejected", err)
+	}
+
+	corrupt[0] ^= 0xff
+	if _, err := NewMessageReader(bytes.NewBuffer(corrupt), MaxFrameSize(DefaultConsensusParams())).ReadMessage(); err != ErrFrameMagic {
+		t.Error("Frame with wrong magic not rejected", err)
+	}
+}
@@ -0,0 +1,192 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/izqui/helpers"
+)
+
+var (
+	ErrWrongNetwork        = errors.New("Peer is on a different network")
+	ErrIncompatibleVersion = errors.New("Peer protocol version isn't supported")
+	ErrSelfConnection      = errors.New("Peer is this node")
+	ErrHandshakeRequired   = errors.New("Message received before the handshake")
+	ErrHandshakeRepeated   = errors.New("Handshake message received twice")
+)
+
+// First message sent on every connection, both ways. Until a peer has sent its version and
+// acknowledged ours with MESSAGE_VERACK no other message is accepted from it or sent to it.
+//
+//	protocol version (4 bytes) | network magic (4 bytes) | public key | best block hash (32 bytes) |
+//	best block height (4 bytes) | listen address length (1 byte) | listen address |
+//	user agent length (1 byte) | user agent
+type PeerVersion struct {
+	Protocol  uint32
+	Magic     uint32
+	PublicKey []byte
+	// Tip of the main chain, an empty hash while the chain is empty
+	BestHash      []byte
+	BestHeight    uint32
+	ListenAddress string
+	UserAgent     string
+}
+
+func (v *PeerVersion) MarshalBinary() ([]byte, error) {
+
+	if len(v.ListenAddress) > 255 || len(v.UserAgent) > 255 {
+		return nil, ErrEncodingOverrun
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, v.Protocol)
+	binary.Write(buf, binary.LittleEndian, v.Magic)
+	buf.Write(helpers.FitBytesInto(v.PublicKey, NETWORK_KEY_SIZE))
+	buf.Write(helpers.FitBytesInto(v.BestHash, 32))
+	binary.Write(buf, binary.LittleEndian, v.BestHeight)
+	buf.WriteByte(byte(len(v.ListenAddress)))
+	buf.WriteString(v.ListenAddress)
+	buf.WriteByte(byte(len(v.UserAgent)))
+	buf.WriteString(v.UserAgent)
+
+	return buf.Bytes(), nil
+}
+
+func (v *PeerVersion) UnmarshalBinary(d []byte) error {
+
+	if len(d) < 4+4+NETWORK_KEY_SIZE+32+4+1 {
+		return ErrEncodingTruncated
+	}
+
+	buf := bytes.NewBuffer(d)
+	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &v.Protocol)
+	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &v.Magic)
+	v.PublicKey = helpers.StripByte(buf.Next(NETWORK_KEY_SIZE), 0)
+	// Block hashes start with zeros, only an all zero hash is empty
+	v.BestHash = buf.Next(32)
+	if bytes.Equal(v.BestHash, make([]byte, 32)) {
+		v.BestHash = nil
+	}
+	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &v.BestHeight)
+
+	for _, s := range []*string{&v.ListenAddress, &v.UserAgent} {
+
+		l, err := buf.ReadByte()
+		if err != nil || buf.Len() < int(l) {
+			return ErrEncodingTruncated
+		}
+		*s = string(buf.Next(int(l)))
+	}
+
+	if buf.Len() > 0 {
+		return ErrEncodingOverrun
+	}
+
+	return nil
+}
+
+// What we tell peers about ourselves
+func (n *Network) localVersion() PeerVersion {
+
+	v := PeerVersion{
+		Protocol:      PROTOCOL_VERSION,
+		Magic:         n.node.options.NetworkMagic,
+		PublicKey:     n.node.Keypair.Public,
+		ListenAddress: n.Address,
+		UserAgent:     n.node.options.UserAgent,
+	}
+	if tip := n.node.Blockchain.Tip(); tip != nil {
+		v.BestHash = tip.Hash()
+		v.BestHeight = uint32(n.node.Blockchain.BlockHeight(v.BestHash))
+	}
+
+	return v
+}
+
+func (n *Network) sendVersion(p *Peer) error {
+
+	v := n.localVersion()
+
+	m := NewMessage(MESSAGE_VERSION)
+	m.Data, _ = v.MarshalBinary()
+
+	return n.send(p, *m)
+}
+
+// Handles the messages of a peer that hasn't completed the handshake yet, any error means it
+// has to be disconnected
+func (n *Network) handshake(p *Peer, m *Message) error {
+
+	switch m.Identifier {
+	case MESSAGE_VERSION:
+		if p.Version != nil {
+			return ErrHandshakeRepeated
+		}
+
+		v := new(PeerVersion)
+		if err := v.UnmarshalBinary(m.Data); err != nil {
+			return err
+		}
+		if v.Magic != n.node.options.NetworkMagic {
+			return ErrWrongNetwork
+		}
+		if v.Protocol < MIN_PROTOCOL_VERSION {
+			return ErrIncompatibleVersion
+		}
+		if bytes.Equal(v.PublicKey, n.node.Keypair.Public) {
+			return ErrSelfConnection
+		}
+		// Over the encrypted transport the key is authenticated, so the peer can't claim another one
+		if n.transport != nil && !bytes.Equal(v.PublicKey, transportPeerKey(p.Conn)) {
+			return ErrPeerKeyMismatch
+		}
+		if p.expectedKey != nil && !bytes.Equal(v.PublicKey, p.expectedKey) {
+			return ErrUnexpectedPeerKey
+		}
+		p.Version = v
+
+		if err := n.send(p, *NewMessage(MESSAGE_VERACK)); err != nil {
+			return err
+		}
+
+	case MESSAGE_VERACK:
+		if p.verack {
+			return ErrHandshakeRepeated
+		}
+		p.verack = true
+
+	default:
+		return ErrHandshakeRequired
+	}
+
+	if p.Version != nil && p.verack {
+		n.peerReady(p)
+	}
+
+	return nil
+}
+
+// The handshake is done: the peer starts getting broadcasts, we learn its listen address and ask
+// for its headers if its chain has a tip we don't know
+func (n *Network) peerReady(p *Peer) {
+
+	p.Conn.SetReadDeadline(time.Time{})
+
+	n.peersLock.Lock()
+	p.ready = true
+	n.peersLock.Unlock()
+
+	fmt.Println("Handshake done with", p.address, p.Version.UserAgent, "height", p.Version.BestHeight)
+
+	if host := nodeHost(p.Version.ListenAddress); host != "" {
+		n.AddressBook.Seen(host, uint32(time.Now().Unix()))
+	}
+
+	if len(p.Version.BestHash) > 0 && !n.node.Blockchain.HasBlock(p.Version.BestHash) {
+		n.node.spawn(func() { n.node.Syncer.RequestHeadersFrom(p.address) })
+	}
+	n.node.spawn(func() { n.SendTo(p.address, *NewMessage(MESSAGE_GET_NODES)) })
+}
@@ -0,0 +1,142 @@
+package core
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPeerVersionMarshalling(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	v := PeerVersion{
+		Protocol:      PROTOCOL_VERSION,
+		Magic:         MESSAGE_MAGIC,
+		PublicKey:     kp.Public,
+		BestHash:      append([]byte{0, 0}, make([]byte, 30)...),
+		BestHeight:    42,
+		ListenAddress: "10.0.5.33:9119",
+		UserAgent:     USER_AGENT,
+	}
+	v.BestHash[31] = 1
+
+	data, err := v.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newV := new(PeerVersion)
+	if err := newV.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*newV, v) {
+		t.Error("Marshall, unmarshall failed", newV)
+	}
+
+	if err := new(PeerVersion).UnmarshalBinary(data[:len(data)-1]); err != ErrEncodingTruncated {
+		t.Error("Truncated version not rejected", err)
+	}
+	if err := new(PeerVersion).UnmarshalBinary(append(data, 0)); err != ErrEncodingOverrun {
+		t.Error("Trailing bytes not rejected", err)
+	}
+}
+
+// Raw connection to n that skips the handshake or breaks it, n is expected to hang up
+func expectHangUp(t *testing.T, n *Node, messages ...*Message) {
+
+	con, err := net.Dial("tcp4", n.Network.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+
+	w := NewMessageWriter(con, MaxFrameSize(DefaultConsensusParams()))
+	for _, m := range messages {
+		w.WriteMessage(m)
+	}
+
+	// Only handshake messages come back before the connection is closed
+	con.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := NewMessageReader(con, MaxFrameSize(DefaultConsensusParams()))
+	for {
+
+		m, err := r.ReadMessage()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Error("Connection not closed")
+			}
+			return
+		}
+		if m.Identifier != MESSAGE_VERSION && m.Identifier != MESSAGE_VERACK {
+			t.Error("Unexpected message before the handshake", m.Identifier)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+
+	a, _ := NewNode(NodeOptions{Keypair: GenerateNewKeypair(), Address: freeLocalAddress()})
+	if err := a.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+
+	version := func(v PeerVersion) *Message {
+		m := NewMessage(MESSAGE_VERSION)
+		m.Data, _ = v.MarshalBinary()
+		return m
+	}
+	valid := PeerVersion{Protocol: PROTOCOL_VERSION, Magic: MESSAGE_MAGIC, PublicKey: GenerateNewKeypair().Public}
+
+	expectHangUp(t, a, NewMessage(MESSAGE_GET_NODES))
+	expectHangUp(t, a, &Message{Identifier: MESSAGE_VERSION, Data: make([]byte, MAX_HANDSHAKE_FRAME_SIZE+1)})
+
+	wrongNetwork := valid
+	wrongNetwork.Magic++
+	expectHangUp(t, a, version(wrongNetwork))
+
+	oldProtocol := valid
+	oldProtocol.Protocol = MIN_PROTOCOL_VERSION - 1
+	expectHangUp(t, a, version(oldProtocol))
+
+	self := valid
+	self.PublicKey = a.Keypair.Public
+	expectHangUp(t, a, version(self))
+
+	expectHangUp(t, a, version(valid), version(valid))
+
+	// Nodes of another network never become peers
+	c, _ := NewNode(NodeOptions{Keypair: GenerateNewKeypair(), Address: freeLocalAddress(), NetworkMagic: MESSAGE_MAGIC + 1})
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	c.Network.ConnectToPeer(context.Background(), a.Network.Address, time.Second, false, c.Network.ConnectionCallback)
+	time.Sleep(200 * time.Millisecond)
+	if a.Network.PeerCount() != 0 || c.Network.PeerCount() != 0 {
+		t.Error("Peers on different networks connected")
+	}
+
+	// A node of the same network learns our version
+	b, _ := NewNode(NodeOptions{Keypair: GenerateNewKeypair(), Address: freeLocalAddress(), UserAgent: "/test/"})
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+
+	b.Network.ConnectToPeer(context.Background(), a.Network.Address, time.Second, false, b.Network.ConnectionCallback)
+	for i := 0; i < 100 && a.Network.PeerCount() == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if a.Network.PeerCount() != 1 {
+		t.Fatal("Handshake not completed")
+	}
+
+	p := a.Network.Peer(a.Network.PeerAddresses()[0])
+	if p.Version.UserAgent != "/test/" || p.Version.ListenAddress != b.Network.Address || !reflect.DeepEqual(p.Version.PublicKey, b.Keypair.Public) {
+		t.Error("Wrong peer version", p.Version)
+	}
+}
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/izqui/helpers"
+)
+
+var (
+	ErrInvalidDerivationPath = errors.New("Derivation paths look like m/0'/1")
+	ErrInvalidDerivedKey     = errors.New("Derived key is out of the curve order, use the next index")
+)
+
+// Private key that can derive child keys, following BIP32 on P-224.
+// Indexes from HARDENED_KEY_START are hardened: their children can't be linked to the parent public key.
+type ExtendedKey struct {
+	key       *big.Int
+	chainCode []byte
+
+	Depth uint8
+	Index uint32
+}
+
+func NewMasterKey(seed []byte) (*ExtendedKey, error) {
+
+	if len(seed) < 16 {
+		return nil, errors.New("Seed must be at least 16 bytes")
+	}
+
+	mac := hmac.New(sha512.New, []byte(HD_MASTER_KEY))
+	mac.Write(seed)
+
+	return newExtendedKey(mac.Sum(nil), nil, 0, 0)
+}
+
+// Child private key:
+//
+//	I = HMAC-SHA512(chain code, 0x00 || private key || index) for hardened indexes
+//	I = HMAC-SHA512(chain code, public key point || index) otherwise
+//
+// the first 28 bytes of I are added to the parent key and the last 32 are the child chain code.
+func (k *ExtendedKey) Child(index uint32) (*ExtendedKey, error) {
+
+	curve := elliptic.P224()
+
+	data := []byte{}
+	if index >= HARDENED_KEY_START {
+		data = append([]byte{0}, helpers.FitBytesInto(k.key.Bytes(), KEY_SIZE)...)
+	} else {
+		x, y := curve.ScalarBaseMult(k.key.Bytes())
+		data = elliptic.Marshal(curve, x, y)
+	}
+	i := make([]byte, 4)
+	binary.BigEndian.PutUint32(i, index)
+	data = append(data, i...)
+
+	mac := hmac.New(sha512.New, k.chainCode)
+	mac.Write(data)
+
+	return newExtendedKey(mac.Sum(nil), k.key, k.Depth+1, index)
+}
+
+// Derives the key at path, like m/0'/1/2' where ' (or h) marks hardened indexes
+func (k *ExtendedKey) Derive(path string) (*ExtendedKey, error) {
+
+	parts := strings.Split(path, "/")
+	if parts[0] != "m" {
+		return nil, ErrInvalidDerivationPath
+	}
+
+	key := k
+	for _, p := range parts[1:] {
+
+		hardened := strings.HasSuffix(p, "'") || strings.HasSuffix(p, "h")
+		if hardened {
+			p = p[:len(p)-1]
+		}
+
+		i, err := strconv.ParseUint(p, 10, 32)
+		if err != nil || i >= HARDENED_KEY_START {
+			return nil, ErrInvalidDerivationPath
+		}
+		if hardened {
+			i += HARDENED_KEY_START
+		}
+
+		if key, err = key.Child(uint32(i)); err != nil {
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
+
+func (k *ExtendedKey) Keypair() *Keypair {
+
+	return KeypairFromPrivate(k.key)
+}
+
+func newExtendedKey(i []byte, parent *big.Int, depth uint8, index uint32) (*ExtendedKey, error) {
+
+	n := elliptic.P224().Params().N
+
+	key := new(big.Int).SetBytes(i[:KEY_SIZE])
+	if key.Cmp(n) >= 0 {
+		return nil, ErrInvalidDerivedKey
+	}
+
+	if parent != nil {
+		key.Add(key, parent).Mod(key, n)
+	}
+	if key.Sign() == 0 {
+		return nil, ErrInvalidDerivedKey
+	}
+
+	return &ExtendedKey{key: key, chainCode: i[32:], Depth: depth, Index: index}, nil
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMnemonic(t *testing.T) {
+
+	entropy := []byte("0123456789abcdef")
+	m, err := EntropyToMnemonic(entropy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := MnemonicToEntropy(" " + m + " ")
+	if err != nil || !bytes.Equal(decoded, entropy) {
+		t.Error("Mnemonic doesn't round trip", err)
+	}
+
+	words := []byte(m)
+	words[0], words[1] = words[1], words[0]
+	if _, err := MnemonicToEntropy(string(words)); err != ErrMnemonicWord {
+		t.Error("Mnemonic with unknown word accepted", err)
+	}
+
+	other, _ := EntropyToMnemonic([]byte("0123456789abcdeg"))
+	swapped := other[:len(other)-4] + m[len(m)-4:]
+	if _, err := MnemonicToEntropy(swapped); err != ErrMnemonicChecksum {
+		t.Error("Mnemonic with wrong checksum accepted", err)
+	}
+
+	if _, err := EntropyToMnemonic(entropy[:10]); err != ErrMnemonicEntropy {
+		t.Error("Short entropy accepted", err)
+	}
+}
+
+func TestKeyDerivation(t *testing.T) {
+
+	m, _ := NewMnemonic(16)
+	seed, err := MnemonicToSeed(m, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSeed, _ := MnemonicToSeed(m, "passphrase")
+	if bytes.Equal(seed, otherSeed) {
+		t.Error("Passphrase doesn't change the seed")
+	}
+
+	master, err := NewMasterKey(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := master.Derive("m/0'/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := master.Derive("m/0h/1")
+	hardened, _ := master.Child(HARDENED_KEY_START)
+	c, _ := hardened.Child(1)
+	if !bytes.Equal(a.Keypair().Public, b.Keypair().Public) || !bytes.Equal(a.Keypair().Public, c.Keypair().Public) {
+		t.Error("Same path derives different keys")
+	}
+
+	sibling, _ := master.Derive("m/0'/2")
+	if bytes.Equal(a.Keypair().Public, sibling.Keypair().Public) || a.Depth != 2 || a.Index != 1 {
+		t.Error("Wrong derived key")
+	}
+
+	kp := a.Keypair()
+	hash := make([]byte, 32)
+	sig, _ := kp.Sign(hash)
+	if !SignatureVerify(kp.Public, sig, hash) {
+		t.Error("Derived keypair can't sign")
+	}
+
+	for _, p := range []string{"0/1", "m/x", "m/2147483648", "m/1''"} {
+		if _, err := master.Derive(p); err != ErrInvalidDerivationPath {
+			t.Error("Invalid path accepted", p)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package core
+
+// Main chain transactions by hash, sender and recipient. Entries are positions in BlockSlice, so they
+// are added when a block is connected and dropped when it is rolled back in a reorganization.
+type TransactionIndex struct {
+	hashes   map[string]transactionPosition
+	sent     map[string][]transactionPosition
+	received map[string][]transactionPosition
+}
+
+type transactionPosition struct {
+	Height int
+	Index  int
+}
+
+// Transaction of the main chain with the block that includes it
+type IndexedTransaction struct {
+	Transaction
+	Block  []byte
+	Height int
+}
+
+func NewTransactionIndex() *TransactionIndex {
+
+	return &TransactionIndex{
+		hashes:   map[string]transactionPosition{},
+		sent:     map[string][]transactionPosition{},
+		received: map[string][]transactionPosition{},
+	}
+}
+
+func (ix *TransactionIndex) connect(height int, b Block) {
+
+	for i, t := range *b.TransactionSlice {
+
+		p := transactionPosition{height, i}
+		ix.hashes[string(t.Hash())] = p
+		if len(t.Header.From) > 0 {
+			ix.sent[string(t.Header.From)] = append(ix.sent[string(t.Header.From)], p)
+		}
+		if len(t.Header.To) > 0 {
+			ix.received[string(t.Header.To)] = append(ix.received[string(t.Header.To)], p)
+		}
+	}
+}
+
+// Blocks are rolled back from the tip, so their entries are always the last ones of each key
+func (ix *TransactionIndex) disconnect(height int, b Block) {
+
+	drop := func(m map[string][]transactionPosition, key []byte) {
+
+		ps := m[string(key)]
+		for len(ps) > 0 && ps[len(ps)-1].Height == height {
+			ps = ps[:len(ps)-1]
+		}
+		if len(ps) == 0 {
+			delete(m, string(key))
+		} else {
+			m[string(key)] = ps
+		}
+	}
+
+	for _, t := range *b.TransactionSlice {
+		if ix.hashes[string(t.Hash())].Height == height {
+			delete(ix.hashes, string(t.Hash()))
+		}
+		drop(ix.sent, t.Header.From)
+		drop(ix.received, t.Header.To)
+	}
+}
+
+// Transactions addressed to key, oldest first
+func (bl *Blockchain) Inbox(key []byte) []IndexedTransaction {
+
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	return bl.indexedTransactions(bl.Index.received[string(key)])
+}
+
+// Transactions sent by key, oldest first
+func (bl *Blockchain) Outbox(key []byte) []IndexedTransaction {
+
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	return bl.indexedTransactions(bl.Index.sent[string(key)])
+}
+
+func (bl *Blockchain) indexedTransactions(ps []transactionPosition) []IndexedTransaction {
+
+	ts := make([]IndexedTransaction, 0, len(ps))
+	for _, p := range ps {
+
+		b := bl.BlockSlice[p.Height]
+		ts = append(ts, IndexedTransaction{(*b.TransactionSlice)[p.Index], b.Hash(), p.Height})
+	}
+
+	return ts
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTransactionIndex(t *testing.T) {
+
+	alice, bob, miner := GenerateNewKeypair(), GenerateNewKeypair(), GenerateNewKeypair()
+	bl := newTestNode(miner).Blockchain
+
+	toBob := NewTransaction(alice.Public, bob.Public, []byte("to bob"))
+	toBob.Signature = toBob.Sign(alice)
+	toAlice := NewTransaction(bob.Public, alice.Public, []byte("to alice"))
+	toAlice.Signature = toAlice.Sign(bob)
+
+	genesis := newTestBlock(miner, nil, toBob)
+	a1 := newTestBlock(miner, &genesis, toAlice)
+	for _, b := range []Block{genesis, a1} {
+		if err := bl.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inbox := bl.Inbox(bob.Public)
+	if len(inbox) != 1 || !bytes.Equal(inbox[0].Hash(), toBob.Hash()) || !bytes.Equal(inbox[0].Block, genesis.Hash()) || inbox[0].Height != 0 {
+		t.Error("Wrong inbox for bob", inbox)
+	}
+	outbox := bl.Outbox(bob.Public)
+	if len(outbox) != 1 || !bytes.Equal(outbox[0].Hash(), toAlice.Hash()) || outbox[0].Height != 1 {
+		t.Error("Wrong outbox for bob", outbox)
+	}
+	if tr, b := bl.FindTransaction(toAlice.Hash()); tr == nil || !bytes.Equal(b.Hash(), a1.Hash()) {
+		t.Error("Transaction not found by hash")
+	}
+
+	// The branch without a1 wins, bob's transaction isn't in the chain anymore
+	b1 := newTestBlock(miner, &genesis, newTestTransaction(alice))
+	b2 := newTestBlock(miner, &b1)
+	for _, b := range []Block{b1, b2} {
+		if err := bl.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if tr, _ := bl.FindTransaction(toAlice.Hash()); tr != nil || len(bl.Outbox(bob.Public)) != 0 || len(bl.Inbox(alice.Public)) != 0 {
+		t.Error("Rolled back transaction still indexed")
+	}
+	if outbox := bl.Outbox(alice.Public); len(outbox) != 2 || outbox[1].Height != 1 {
+		t.Error("Wrong outbox for alice after reorganization", outbox)
+	}
+	if inbox := bl.Inbox(miner.Public); len(inbox) != 3 || !inbox[2].IsCoinbase() || inbox[2].Height != 2 {
+		t.Error("Coinbases not indexed for the miner", inbox)
+	}
+	if len(bl.Inbox(bob.Public)) != 1 {
+		t.Error("Transactions before the fork dropped from the index")
+	}
+}
+
+func TestCreateAddressedTransaction(t *testing.T) {
+
+	kp, to := GenerateNewKeypair(), GenerateNewKeypair()
+	node := newTestNode(kp)
+
+	tr, err := node.CreateTransaction(to.Public, "hola")
+	if err != nil || !bytes.Equal(tr.Header.To, to.Public) || tr.VerifyTransaction(node.options.TransactionPow, node.options.Consensus) != nil {
+		t.Error("Addressed transaction not created", err)
+	}
+
+	if _, err := node.CreateTransaction([]byte("nobody"), "hola"); err != ErrInvalidRecipient {
+		t.Error("Transaction to an invalid key created", err)
+	}
+}
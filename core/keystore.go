@@ -0,0 +1,345 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	ErrKeyNotFound       = errors.New("No key with that name in the keystore")
+	ErrKeyExists         = errors.New("A key with that name is already in the keystore")
+	ErrKeyLocked         = errors.New("Key is locked")
+	ErrWrongPassphrase   = errors.New("Wrong passphrase")
+	ErrInvalidKeyName    = errors.New("Key names can only have letters, digits, - and _")
+	ErrUnsupportedCrypto = errors.New("Unsupported keystore encryption")
+)
+
+var keyNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// Named keypairs whose private keys are kept encrypted on disk, one file per key.
+// A key has to be unlocked with its passphrase before it can sign, and it can be locked
+// again after a timeout.
+type Keystore struct {
+	// Cost of the passphrase key derivation for new keys, every key file has its own
+	ScryptN, ScryptR, ScryptP int
+
+	directory string
+	keys      map[string]*keyFile
+	unlocked  map[string]*unlockedKey
+
+	lock sync.Mutex
+}
+
+type keyFile struct {
+	Name   string    `json:"name"`
+	Public string    `json:"public"`
+	Crypto keyCrypto `json:"crypto"`
+}
+
+// The private key is encrypted with AES-256-GCM under a key derived from the passphrase with scrypt.
+// The public key goes as additional data, so the ciphertext can't be moved to another key.
+type keyCrypto struct {
+	Cipher     string `json:"cipher"`
+	Ciphertext string `json:"ciphertext"`
+	Nonce      string `json:"nonce"`
+	KDF        string `json:"kdf"`
+	Salt       string `json:"salt"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+}
+
+type unlockedKey struct {
+	*Keypair
+	timer *time.Timer
+}
+
+func OpenKeystore(directory string) (*Keystore, error) {
+
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+
+	ks := &Keystore{
+		ScryptN: KEYSTORE_SCRYPT_N,
+		ScryptR: KEYSTORE_SCRYPT_R,
+		ScryptP: KEYSTORE_SCRYPT_P,
+
+		directory: directory,
+		keys:      map[string]*keyFile{},
+		unlocked:  map[string]*unlockedKey{},
+	}
+
+	files, err := filepath.Glob(filepath.Join(directory, "*"+KEYSTORE_FILE_EXTENSION))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		kf := new(keyFile)
+		if err := json.Unmarshal(data, kf); err != nil {
+			return nil, err
+		}
+		if kf.Name != strings.TrimSuffix(filepath.Base(f), KEYSTORE_FILE_EXTENSION) {
+			return nil, errors.New("Key file " + f + " doesn't match its name")
+		}
+		ks.keys[kf.Name] = kf
+	}
+
+	return ks, nil
+}
+
+// Generates a new keypair and stores it encrypted with passphrase. The key is left locked.
+func (ks *Keystore) Create(name, passphrase string) ([]byte, error) {
+
+	kp := GenerateNewKeypair()
+
+	return kp.Public, ks.Import(name, kp, passphrase)
+}
+
+// Stores an existing keypair encrypted with passphrase
+func (ks *Keystore) Import(name string, kp *Keypair, passphrase string) error {
+
+	if !keyNameRegexp.MatchString(name) {
+		return ErrInvalidKeyName
+	}
+
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	if ks.keys[name] != nil {
+		return ErrKeyExists
+	}
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	c := keyCrypto{Cipher: "aes-256-gcm", KDF: "scrypt", Salt: hex.EncodeToString(salt), N: ks.ScryptN, R: ks.ScryptR, P: ks.ScryptP}
+	gcm, err := c.aead(passphrase)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	c.Nonce = hex.EncodeToString(nonce)
+	c.Ciphertext = hex.EncodeToString(gcm.Seal(nil, nonce, kp.Private, kp.Public))
+
+	kf := &keyFile{Name: name, Public: string(kp.Public), Crypto: c}
+	if err := ks.write(kf); err != nil {
+		return err
+	}
+	ks.keys[name] = kf
+
+	return nil
+}
+
+// Decrypts the private key so it can sign. With a timeout greater than zero the key is locked
+// again after it, otherwise it stays unlocked until Lock is called.
+func (ks *Keystore) Unlock(name, passphrase string, timeout time.Duration) error {
+
+	ks.lock.Lock()
+	kf := ks.keys[name]
+	ks.lock.Unlock()
+
+	if kf == nil {
+		return ErrKeyNotFound
+	}
+
+	// The key derivation is slow on purpose, don't hold the lock meanwhile
+	private, err := kf.Crypto.decrypt(passphrase, []byte(kf.Public))
+	if err != nil {
+		return err
+	}
+
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	ks.lockKey(name)
+
+	u := &unlockedKey{Keypair: &Keypair{Public: []byte(kf.Public), Private: private}}
+	if timeout > 0 {
+		u.timer = time.AfterFunc(timeout, func() {
+
+			ks.lock.Lock()
+			defer ks.lock.Unlock()
+
+			// The key could have been locked and unlocked again meanwhile
+			if ks.unlocked[name] == u {
+				ks.lockKey(name)
+			}
+		})
+	}
+	ks.unlocked[name] = u
+
+	return nil
+}
+
+func (ks *Keystore) Lock(name string) {
+
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	ks.lockKey(name)
+}
+
+func (ks *Keystore) LockAll() {
+
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	for name := range ks.unlocked {
+		ks.lockKey(name)
+	}
+}
+
+// Keypair able to sign, only while the key is unlocked
+func (ks *Keystore) Keypair(name string) (*Keypair, error) {
+
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	if ks.keys[name] == nil {
+		return nil, ErrKeyNotFound
+	}
+
+	u := ks.unlocked[name]
+	if u == nil {
+		return nil, ErrKeyLocked
+	}
+
+	return &Keypair{Public: u.Public, Private: append([]byte{}, u.Private...)}, nil
+}
+
+// Public keys are readable while the key is locked
+func (ks *Keystore) Public(name string) ([]byte, error) {
+
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	kf := ks.keys[name]
+	if kf == nil {
+		return nil, ErrKeyNotFound
+	}
+
+	return []byte(kf.Public), nil
+}
+
+func (ks *Keystore) Names() []string {
+
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	names := make([]string, 0, len(ks.keys))
+	for n := range ks.keys {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (ks *Keystore) lockKey(name string) {
+
+	u := ks.unlocked[name]
+	if u == nil {
+		return
+	}
+
+	if u.timer != nil {
+		u.timer.Stop()
+	}
+	for i := range u.Private {
+		u.Private[i] = 0
+	}
+	delete(ks.unlocked, name)
+}
+
+// Written to a temporary file first so a crash never leaves a half written key
+func (ks *Keystore) write(kf *keyFile) error {
+
+	data, err := json.MarshalIndent(kf, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(ks.directory, kf.Name+KEYSTORE_FILE_EXTENSION)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (c *keyCrypto) aead(passphrase string) (cipher.AEAD, error) {
+
+	if c.Cipher != "aes-256-gcm" || c.KDF != "scrypt" {
+		return nil, ErrUnsupportedCrypto
+	}
+
+	salt, err := hex.DecodeString(c.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), salt, c.N, c.R, c.P, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (c *keyCrypto) decrypt(passphrase string, public []byte) ([]byte, error) {
+
+	gcm, err := c.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := hex.DecodeString(c.Nonce)
+	if err != nil || len(nonce) != gcm.NonceSize() {
+		return nil, ErrUnsupportedCrypto
+	}
+	ciphertext, err := hex.DecodeString(c.Ciphertext)
+	if err != nil {
+		return nil, ErrUnsupportedCrypto
+	}
+
+	private, err := gcm.Open(nil, nonce, ciphertext, public)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	return private, nil
+}
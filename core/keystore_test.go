@@ -0,0 +1,125 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestKeystore(t *testing.T, dir string) *Keystore {
+
+	ks, err := OpenKeystore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cheap key derivation, tests don't need the real cost
+	ks.ScryptN = 1 << 10
+
+	return ks
+}
+
+func TestKeystore(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "keystore")
+	defer os.RemoveAll(dir)
+
+	ks := newTestKeystore(t, dir)
+	public, err := ks.Create("miner", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ks.Create("miner", "secret"); err != ErrKeyExists {
+		t.Error("Key created twice", err)
+	}
+	if _, err := ks.Create("../miner", "secret"); err != ErrInvalidKeyName {
+		t.Error("Invalid key name accepted", err)
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "miner"+KEYSTORE_FILE_EXTENSION))
+	if !bytes.Contains(data, public) || bytes.Contains(data, []byte("private")) {
+		t.Error("Key file should have the public key and not the private one")
+	}
+
+	// Keys survive reopening the keystore and start locked
+	ks = newTestKeystore(t, dir)
+	if _, err := ks.Keypair("miner"); err != ErrKeyLocked {
+		t.Error("Key should start locked", err)
+	}
+	if err := ks.Unlock("miner", "wrong", 0); err != ErrWrongPassphrase {
+		t.Error("Key unlocked with the wrong passphrase", err)
+	}
+	if err := ks.Unlock("miner", "secret", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	kp, err := ks.Keypair("miner")
+	if err != nil || !bytes.Equal(kp.Public, public) {
+		t.Fatal("Unlocked key not available", err)
+	}
+	hash := make([]byte, 32)
+	sig, _ := kp.Sign(hash)
+	if !SignatureVerify(public, sig, hash) {
+		t.Error("Decrypted private key doesn't match the public key")
+	}
+
+	ks.Lock("miner")
+	if _, err := ks.Keypair("miner"); err != ErrKeyLocked {
+		t.Error("Key still unlocked", err)
+	}
+}
+
+func TestKeystoreUnlockTimeout(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "keystore")
+	defer os.RemoveAll(dir)
+
+	ks := newTestKeystore(t, dir)
+	ks.Create("miner", "secret")
+
+	if err := ks.Unlock("miner", "secret", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Keypair("miner"); err != nil {
+		t.Error("Key should be unlocked", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if _, err := ks.Keypair("miner"); err != ErrKeyLocked {
+		t.Error("Key should lock after the timeout", err)
+	}
+}
+
+func TestNodeWithKeystore(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "keystore")
+	defer os.RemoveAll(dir)
+
+	ks := newTestKeystore(t, dir)
+	public, _ := ks.Create("miner", "secret")
+
+	node, err := NewNode(NodeOptions{Keystore: ks, Account: "miner", Address: freeLocalAddress()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(node.Keypair.Public, public) {
+		t.Error("Node should use the keystore account")
+	}
+
+	if _, err := node.CreateTransaction(nil, "hola"); err != ErrKeyLocked {
+		t.Error("Transaction created with a locked key", err)
+	}
+	if err := node.Start(context.Background()); err != ErrKeyLocked {
+		t.Error("Node started with a locked key", err)
+	}
+
+	ks.Unlock("miner", "secret", 0)
+	tr, err := node.CreateTransaction(nil, "hola")
+	if err != nil || tr.VerifyTransaction(TRANSACTION_POW, DefaultConsensusParams()) != nil {
+		t.Error("Transaction not signed with the unlocked key", err)
+	}
+}
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+var (
+	ErrInsufficientBalance = errors.New("Transaction amount is more than the sender balance")
+	ErrBadSequence         = errors.New("Transaction sequence isn't the next one of the sender")
+	ErrNoRecipient         = errors.New("Transactions with an amount need a recipient")
+	ErrBalanceOverflow     = errors.New("Balance overflows")
+)
+
+// Balance of a key and number of transactions it has sent
+type Account struct {
+	Balance  uint64
+	Sequence uint64
+}
+
+// Account state of the main chain, kept when ConsensusParams.Ledger is set. Every block moves the
+// amount of each transaction from sender to recipient, takes the fee from the sender and then
+// credits its coinbase, which collects the fees and can't be spent in the same block.
+// A transaction must carry the next sequence number of its sender, so it can't be replayed.
+type Ledger struct {
+	accounts map[string]Account
+
+	lock sync.RWMutex
+}
+
+// Account changes of blocks not applied to a ledger yet
+type LedgerView struct {
+	ledger  *Ledger
+	changes map[string]Account
+}
+
+func NewLedger() *Ledger {
+
+	return &Ledger{accounts: map[string]Account{}}
+}
+
+func (l *Ledger) Account(key []byte) Account {
+
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	return l.accounts[string(key)]
+}
+
+func (l *Ledger) View() *LedgerView {
+
+	return &LedgerView{ledger: l, changes: map[string]Account{}}
+}
+
+// Applies a block, nothing changes if one of its transactions is invalid
+func (l *Ledger) Connect(b Block) error {
+
+	v := l.View()
+	if err := v.Connect(b); err != nil {
+		return err
+	}
+	v.Commit()
+
+	return nil
+}
+
+// Undoes a block previously connected, blocks go back from the tip
+func (l *Ledger) Disconnect(b Block) {
+
+	v := l.View()
+	v.Disconnect(b)
+	v.Commit()
+}
+
+func (v *LedgerView) Account(key []byte) Account {
+
+	if a, ok := v.changes[string(key)]; ok {
+		return a
+	}
+
+	return v.ledger.Account(key)
+}
+
+func (v *LedgerView) Connect(b Block) error {
+
+	c := b.Coinbase()
+	if c == nil {
+		return ErrBadCoinbase
+	}
+
+	for _, t := range (*b.TransactionSlice)[1:] {
+		if err := v.ApplyTransaction(t); err != nil {
+			return err
+		}
+	}
+
+	return v.credit(c.Header.To, c.Header.Amount)
+}
+
+func (v *LedgerView) Disconnect(b Block) {
+
+	c := b.Coinbase()
+	to := v.Account(c.Header.To)
+	to.Balance -= c.Header.Amount
+	v.set(c.Header.To, to)
+
+	ts := *b.TransactionSlice
+	for i := len(ts) - 1; i >= 1; i-- {
+
+		h := ts[i].Header
+
+		to := v.Account(h.To)
+		to.Balance -= h.Amount
+		v.set(h.To, to)
+
+		from := v.Account(h.From)
+		from.Balance += h.Amount + h.Fee
+		from.Sequence--
+		v.set(h.From, from)
+	}
+}
+
+func (v *LedgerView) ApplyTransaction(t Transaction) error {
+
+	if t.IsCoinbase() {
+		return ErrBadCoinbase
+	}
+
+	h := t.Header
+	from := v.Account(h.From)
+	if h.Sequence != from.Sequence+1 {
+		return ErrBadSequence
+	}
+	if h.Fee > math.MaxUint64-h.Amount || h.Amount+h.Fee > from.Balance {
+		return ErrInsufficientBalance
+	}
+	if h.Amount > 0 && len(h.To) == 0 {
+		return ErrNoRecipient
+	}
+	if to := v.Account(h.To); to.Balance > math.MaxUint64-h.Amount {
+		return ErrBalanceOverflow
+	}
+
+	from.Balance -= h.Amount + h.Fee
+	from.Sequence++
+	v.set(h.From, from)
+
+	return v.credit(h.To, h.Amount)
+}
+
+// Writes the changes to the ledger
+func (v *LedgerView) Commit() {
+
+	v.ledger.lock.Lock()
+	defer v.ledger.lock.Unlock()
+
+	for k, a := range v.changes {
+		if a == (Account{}) {
+			delete(v.ledger.accounts, k)
+		} else {
+			v.ledger.accounts[k] = a
+		}
+	}
+	v.changes = map[string]Account{}
+}
+
+func (v *LedgerView) credit(key []byte, amount uint64) error {
+
+	if amount == 0 {
+		return nil
+	}
+
+	a := v.Account(key)
+	if a.Balance > math.MaxUint64-amount {
+		return ErrBalanceOverflow
+	}
+	a.Balance += amount
+	v.set(key, a)
+
+	return nil
+}
+
+func (v *LedgerView) set(key []byte, a Account) {
+
+	v.changes[string(key)] = a
+}
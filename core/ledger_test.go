@@ -0,0 +1,116 @@
+package core
+
+import (
+	"testing"
+)
+
+func newTestLedgerNode(kp *Keypair) *Node {
+
+	params := DefaultConsensusParams()
+	params.Ledger = true
+
+	node, err := NewNode(NodeOptions{Keypair: kp, Consensus: params})
+	if err != nil {
+		panic(err)
+	}
+
+	return node
+}
+
+func TestLedger(t *testing.T) {
+
+	alice, bob := GenerateNewKeypair(), GenerateNewKeypair()
+	bl := newTestLedgerNode(alice).Blockchain
+
+	genesis := newTestBlock(alice, nil)
+	a1 := newTestBlock(alice, &genesis, newTestTransaction(alice, withTransfer(bob.Public, 10, 1)))
+	for _, b := range []Block{genesis, a1} {
+		if err := bl.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if a := bl.Ledger.Account(alice.Public); a.Balance != 2*BLOCK_REWARD-10 || a.Sequence != 1 {
+		t.Error("Wrong alice account", a)
+	}
+	if a := bl.Ledger.Account(bob.Public); a.Balance != 10 || a.Sequence != 0 {
+		t.Error("Wrong bob account", a)
+	}
+
+	if err := bl.AddBlock(newTestBlock(alice, &a1, newTestTransaction(alice, withTransfer(bob.Public, 10, 1)))); err != ErrBadSequence {
+		t.Error("Replayed sequence accepted", err)
+	}
+	if err := bl.AddBlock(newTestBlock(alice, &a1, newTestTransaction(bob, withTransfer(alice.Public, 11, 1)))); err != ErrInsufficientBalance {
+		t.Error("Overspend accepted", err)
+	}
+	if err := bl.AddBlock(newTestBlock(alice, &a1, newTestTransaction(alice, withTransfer(nil, 1, 2)))); err != ErrNoRecipient {
+		t.Error("Amount without recipient accepted", err)
+	}
+
+	// Side branch blocks are checked against the state of their own branch
+	b1 := newTestBlock(bob, &genesis)
+	if err := bl.AddBlock(b1); err != nil {
+		t.Fatal(err)
+	}
+	if err := bl.AddBlock(newTestBlock(bob, &b1, newTestTransaction(bob, withTransfer(alice.Public, BLOCK_REWARD+1, 1)))); err != ErrInsufficientBalance {
+		t.Error("Overspend in a side branch accepted", err)
+	}
+
+	b2 := newTestBlock(bob, &b1, newTestTransaction(bob, withTransfer(alice.Public, BLOCK_REWARD, 1)))
+	if err := bl.AddBlock(b2); err != nil {
+		t.Fatal(err)
+	}
+
+	// The branch of b2 won, a1 is rolled back
+	if a := bl.Ledger.Account(alice.Public); a.Balance != 2*BLOCK_REWARD || a.Sequence != 0 {
+		t.Error("Wrong alice account after reorganization", a)
+	}
+	if a := bl.Ledger.Account(bob.Public); a.Balance != BLOCK_REWARD || a.Sequence != 1 {
+		t.Error("Wrong bob account after reorganization", a)
+	}
+}
+
+func TestLedgerBlockTemplate(t *testing.T) {
+
+	alice, bob := GenerateNewKeypair(), GenerateNewKeypair()
+	node := newTestLedgerNode(alice)
+	bl := node.Blockchain
+
+	if err := bl.AddBlock(newTestBlock(alice, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	tr1, err := node.CreateTransfer(bob.Public, BLOCK_REWARD-5, 0, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl.Mempool.Add(*tr1)
+	tr2, _ := node.CreateTransfer(bob.Public, 5, 0, "second")
+	bl.Mempool.Add(*tr2)
+	// Alice can't pay this one with the reward of the same block
+	bl.Mempool.Add(*newTestTransaction(alice, withTransfer(bob.Public, 1, 3)))
+
+	if tr2.Header.Sequence != 2 {
+		t.Error("Sequence doesn't count pending transactions", tr2.Header.Sequence)
+	}
+	if err := bl.checkPendingTransaction(*newTestTransaction(alice, withTransfer(bob.Public, 1, 0))); err != ErrBadSequence {
+		t.Error("Replayed transaction accepted in the mempool", err)
+	}
+
+	b := bl.NewBlockTemplate()
+	if b.TransactionSlice.Len() != 3 || b.Coinbase() == nil || b.Coinbase().Header.Sequence != 1 {
+		t.Fatal("Template should have the coinbase and the first two transactions", b.TransactionSlice.Len())
+	}
+
+	b.MerkelRoot = b.GenerateMerkelRoot()
+	b.Signature = b.Sign(alice)
+	if err := bl.AddBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	if a := bl.Ledger.Account(bob.Public); a.Balance != BLOCK_REWARD {
+		t.Error("Wrong bob balance", a)
+	}
+	if b := bl.NewBlockTemplate(); b.TransactionSlice.Len() != 2 {
+		t.Error("Last transaction should fit in the next template", b.TransactionSlice.Len())
+	}
+}
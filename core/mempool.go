@@ -0,0 +1,294 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMempoolDuplicate   = errors.New("Transaction already in mempool")
+	ErrMempoolFull        = errors.New("Mempool is full")
+	ErrMempoolSenderLimit = errors.New("Too many pending transactions from sender")
+	ErrMempoolExpired     = errors.New("Transaction is too old")
+	ErrMempoolFuture      = errors.New("Transaction timestamp is in the future")
+	ErrMempoolCoinbase    = errors.New("Coinbase transactions only go in their own block")
+)
+
+// Transactions waiting to get into a block, indexed by hash.
+// The pool is bounded by count and total size, a sender can only have a few transactions pending
+// and transactions are dropped once their timestamp is older than Expiry.
+// Timestamps are chosen by the sender, so they only count within MEMPOOL_TIMESTAMP_DRIFT of the time
+// the transaction was received.
+type Mempool struct {
+	MaxCount     int
+	MaxSize      int
+	MaxPerSender int
+	Expiry       time.Duration
+
+	entries map[string]*mempoolEntry
+	senders map[string]int
+	size    int
+
+	lock sync.Mutex
+}
+
+type mempoolEntry struct {
+	Transaction
+	hash []byte
+	size int
+	// Timestamp bounded by the time the transaction was received, used for its priority
+	timestamp uint32
+}
+
+func NewMempool() *Mempool {
+
+	return &Mempool{
+		MaxCount:     MEMPOOL_MAX_TRANSACTIONS,
+		MaxSize:      MEMPOOL_MAX_SIZE,
+		MaxPerSender: MEMPOOL_MAX_PER_SENDER,
+		Expiry:       MEMPOOL_EXPIRY,
+
+		entries: map[string]*mempoolEntry{},
+		senders: map[string]int{},
+	}
+}
+
+// Transactions go in order of priority: highest fee per byte first, then oldest timestamp and
+// hash to break ties.
+func (e *mempoolEntry) before(o *mempoolEntry) bool {
+
+	// Compares e.Fee/e.size with o.Fee/o.size without rounding
+	eh, el := bits.Mul64(e.Header.Fee, uint64(o.size))
+	oh, ol := bits.Mul64(o.Header.Fee, uint64(e.size))
+	if eh != oh {
+		return eh > oh
+	}
+	if el != ol {
+		return el > ol
+	}
+
+	if e.timestamp != o.timestamp {
+		return e.timestamp < o.timestamp
+	}
+
+	return bytes.Compare(e.hash, o.hash) < 0
+}
+
+func (mp *Mempool) Add(t Transaction) error {
+
+	return mp.add(t, time.Now())
+}
+
+// Adds t as received at now
+func (mp *Mempool) add(t Transaction, now time.Time) error {
+
+	if t.IsCoinbase() {
+		return ErrMempoolCoinbase
+	}
+
+	data, err := t.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	e := &mempoolEntry{t, t.Hash(), len(data), t.Header.Timestamp}
+	if earliest := uint32(now.Add(-MEMPOOL_TIMESTAMP_DRIFT).Unix()); e.timestamp < earliest {
+		e.timestamp = earliest
+	}
+
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	if mp.entries[string(e.hash)] != nil {
+		return ErrMempoolDuplicate
+	}
+	if mp.expired(e, now) {
+		return ErrMempoolExpired
+	}
+	if time.Unix(int64(t.Header.Timestamp), 0).After(now.Add(MEMPOOL_TIMESTAMP_DRIFT)) {
+		return ErrMempoolFuture
+	}
+	if mp.senders[string(t.Header.From)] >= mp.MaxPerSender {
+		return ErrMempoolSenderLimit
+	}
+	if e.size > mp.MaxSize {
+		return ErrMempoolFull
+	}
+
+	// Make room dropping the lowest priority transactions, as long as they go after the new one
+	for len(mp.entries) >= mp.MaxCount || mp.size+e.size > mp.MaxSize {
+
+		last := mp.last()
+		if last == nil || !e.before(last) {
+			return ErrMempoolFull
+		}
+		mp.remove(last)
+	}
+
+	mp.entries[string(e.hash)] = e
+	mp.senders[string(t.Header.From)]++
+	mp.size += e.size
+
+	return nil
+}
+
+func (mp *Mempool) Has(hash []byte) bool {
+
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	return mp.entries[string(hash)] != nil
+}
+
+func (mp *Mempool) Get(hash []byte) *Transaction {
+
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	if e := mp.entries[string(hash)]; e != nil {
+		t := e.Transaction
+		return &t
+	}
+
+	return nil
+}
+
+// Number of transactions of sender waiting in the pool
+func (mp *Mempool) Pending(sender []byte) int {
+
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	return mp.senders[string(sender)]
+}
+
+func (mp *Mempool) Len() int {
+
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	return len(mp.entries)
+}
+
+// Total size in bytes of the pending transactions
+func (mp *Mempool) Size() int {
+
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	return mp.size
+}
+
+// Drops the transactions included in a block
+func (mp *Mempool) RemoveTransactions(ts TransactionSlice) {
+
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	for _, t := range ts {
+		if e := mp.entries[string(t.Hash())]; e != nil {
+			mp.remove(e)
+		}
+	}
+}
+
+// Drops the transactions whose timestamp is older than Expiry. Returns how many were dropped.
+func (mp *Mempool) Expire(now time.Time) int {
+
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	n := 0
+	for _, e := range mp.entries {
+		if mp.expired(e, now) {
+			mp.remove(e)
+			n++
+		}
+	}
+
+	return n
+}
+
+// Up to max transactions taking up to maxSize bytes in a block, picked greedily in priority order.
+// Transactions that don't fit are skipped, smaller ones after them may still get in.
+func (mp *Mempool) Select(max, maxSize int) TransactionSlice {
+
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	ts := TransactionSlice{}
+	size := 0
+	for _, e := range mp.sorted() {
+
+		if len(ts) >= max {
+			break
+		}
+		// Every transaction goes with its length in the block
+		if size+e.size+4 > maxSize {
+			continue
+		}
+
+		ts = append(ts, e.Transaction)
+		size += e.size + 4
+	}
+
+	return ts
+}
+
+func (mp *Mempool) Transactions() TransactionSlice {
+
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	es := mp.sorted()
+	ts := make(TransactionSlice, len(es))
+	for i, e := range es {
+		ts[i] = e.Transaction
+	}
+
+	return ts
+}
+
+func (mp *Mempool) sorted() []*mempoolEntry {
+
+	es := make([]*mempoolEntry, 0, len(mp.entries))
+	for _, e := range mp.entries {
+		es = append(es, e)
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].before(es[j]) })
+
+	return es
+}
+
+func (mp *Mempool) last() *mempoolEntry {
+
+	var last *mempoolEntry
+	for _, e := range mp.entries {
+		if last == nil || last.before(e) {
+			last = e
+		}
+	}
+
+	return last
+}
+
+func (mp *Mempool) expired(e *mempoolEntry, now time.Time) bool {
+
+	return time.Unix(int64(e.Header.Timestamp), 0).Add(mp.Expiry).Before(now)
+}
+
+func (mp *Mempool) remove(e *mempoolEntry) {
+
+	delete(mp.entries, string(e.hash))
+	mp.size -= e.size
+
+	from := string(e.Header.From)
+	mp.senders[from]--
+	if mp.senders[from] <= 0 {
+		delete(mp.senders, from)
+	}
+}
@@ -0,0 +1,140 @@
+package core
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMempoolLimits(t *testing.T) {
+
+	kp1, kp2 := GenerateNewKeypair(), GenerateNewKeypair()
+
+	mp := NewMempool()
+	mp.MaxCount, mp.MaxPerSender = 3, 2
+
+	tr1, tr2, tr3 := newTestTransaction(kp1), newTestTransaction(kp1), newTestTransaction(kp1)
+	if mp.Add(*tr1) != nil || mp.Add(*tr2) != nil {
+		t.Fatal("Adding transactions fails")
+	}
+	if err := mp.Add(*tr1); err != ErrMempoolDuplicate {
+		t.Error("Duplicate transaction added", err)
+	}
+	if err := mp.Add(*tr3); err != ErrMempoolSenderLimit {
+		t.Error("Sender limit not enforced", err)
+	}
+
+	old := newTestTransaction(kp2)
+	old.Header.Timestamp = uint32(time.Now().Add(-2 * MEMPOOL_EXPIRY).Unix())
+	if err := mp.Add(*old); err != ErrMempoolExpired {
+		t.Error("Expired transaction added", err)
+	}
+
+	// When full, a newer transaction doesn't push older ones out
+	tr4, tr5 := newTestTransaction(kp2), newTestTransaction(kp2)
+	tr4.Header.Timestamp, tr5.Header.Timestamp = tr1.Header.Timestamp+1, tr1.Header.Timestamp+2
+	mp.Add(*tr4)
+	if err := mp.Add(*tr5); err != ErrMempoolFull || mp.Len() != 3 {
+		t.Error("Mempool count cap not enforced", err)
+	}
+
+	mp.RemoveTransactions(TransactionSlice{*tr1})
+	if mp.Has(tr1.Hash()) || mp.Len() != 2 {
+		t.Error("Transaction not removed")
+	}
+
+	if n := mp.Expire(time.Now().Add(2 * MEMPOOL_EXPIRY)); n != 2 || mp.Len() != 0 || mp.Size() != 0 {
+		t.Error("Transactions not expired", n)
+	}
+}
+
+func TestMempoolSelection(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	mp := NewMempool()
+	now := time.Now()
+
+	trs := TransactionSlice{}
+	for i := 0; i < 5; i++ {
+		tr := newTestTransaction(kp)
+		tr.Header.Timestamp = uint32(now.Unix()) - uint32(i)
+		tr.Signature = tr.Sign(kp)
+		trs = append(trs, *tr)
+		mp.add(*tr, now)
+	}
+
+	selected := mp.Select(3, MAX_BLOCK_SIZE)
+	if len(selected) != 3 {
+		t.Fatal("Selection not capped", len(selected))
+	}
+	for i, tr := range selected {
+		if !reflect.DeepEqual(tr.Hash(), trs[4-i].Hash()) {
+			t.Error("Transactions not selected oldest first")
+		}
+	}
+
+	if !reflect.DeepEqual(mp.Select(5, MAX_BLOCK_SIZE), mp.Select(5, MAX_BLOCK_SIZE)) {
+		t.Error("Selection is not deterministic")
+	}
+}
+
+func TestMempoolTimestamps(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	mp := NewMempool()
+	now := time.Now()
+
+	future := newTestTransaction(kp)
+	future.Header.Timestamp = uint32(now.Add(2 * MEMPOOL_TIMESTAMP_DRIFT).Unix())
+	future.Signature = future.Sign(kp)
+	if err := mp.add(*future, now); err != ErrMempoolFuture {
+		t.Error("Transaction from the future added", err)
+	}
+
+	// Backdating a transaction only gains up to the drift, both go as received at the same time
+	old, older := newTestTransaction(kp), newTestTransaction(kp)
+	old.Header.Timestamp = uint32(now.Add(-time.Hour).Unix())
+	older.Header.Timestamp = uint32(now.Add(-2 * time.Hour).Unix())
+	for _, tr := range []*Transaction{old, older} {
+		tr.Signature = tr.Sign(kp)
+		mp.add(*tr, now)
+	}
+
+	first, second := old, older
+	if bytes.Compare(older.Hash(), old.Hash()) < 0 {
+		first, second = older, old
+	}
+	selected := mp.Select(2, MAX_BLOCK_SIZE)
+	if len(selected) != 2 || !reflect.DeepEqual(selected[0].Hash(), first.Hash()) || !reflect.DeepEqual(selected[1].Hash(), second.Hash()) {
+		t.Error("Backdated transaction gets priority")
+	}
+}
+
+func TestMempoolFeeSelection(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	mp := NewMempool()
+
+	cheap, rich, big := newTestTransaction(kp), newTestTransaction(kp), newTestTransaction(kp)
+	cheap.Header.Fee = 1
+	rich.Header.Fee = 1000000
+	big.Payload = make([]byte, 4096)
+	big.Header.PayloadLength = uint32(len(big.Payload))
+	big.Header.Fee = 100 * uint64(big.Size())
+	for _, tr := range []*Transaction{cheap, rich, big} {
+		tr.Signature = tr.Sign(kp)
+		mp.Add(*tr)
+	}
+
+	selected := mp.Select(3, MAX_BLOCK_SIZE)
+	if len(selected) != 3 || !reflect.DeepEqual(selected[0].Hash(), rich.Hash()) || !reflect.DeepEqual(selected[2].Hash(), cheap.Hash()) {
+		t.Error("Transactions not selected by fee rate")
+	}
+
+	// The big one doesn't fit, the cheap one after it still does
+	selected = mp.Select(3, rich.Size()+cheap.Size()+8)
+	if len(selected) != 2 || !reflect.DeepEqual(selected[1].Hash(), cheap.Hash()) {
+		t.Error("Selection doesn't skip transactions that don't fit", len(selected))
+	}
+}
@@ -0,0 +1,334 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+
+	"github.com/izqui/helpers"
+)
+
+var ErrMerkleProofIndex = errors.New("Transaction index out of the block")
+
+// Audit path proving that a transaction is part of a block: the sibling hashes from the
+// transaction up to the merkel root, so the root can be rebuilt without the rest of the block.
+type MerkleProof struct {
+	Hash  []byte
+	Index uint32
+	Steps []MerkleProofStep
+}
+
+type MerkleProofStep struct {
+	Hash []byte
+	// The sibling goes on the left side when hashing the pair
+	Left bool
+}
+
+// Domain separation prefixes of the tagged tree, so a leaf can never be passed off as an inner node
+const (
+	MERKLE_LEAF_TAG = 0x00
+	MERKLE_NODE_TAG = 0x01
+)
+
+// Root of the merkel tree of the given header version
+func merkleRoot(version uint32, hashes [][]byte) []byte {
+
+	if version == BLOCK_VERSION_LEGACY_MERKLE {
+		return legacyMerkleRoot(hashes)
+	}
+
+	return taggedMerkleRoot(hashes)
+}
+
+// Siblings of hashes[index] on its way to the root of the tree of the given header version
+func merklePath(version uint32, hashes [][]byte, index int) []MerkleProofStep {
+
+	if version == BLOCK_VERSION_LEGACY_MERKLE {
+		return legacyMerklePath(hashes, index)
+	}
+
+	return taggedMerklePath(hashes, index)
+}
+
+// Tagged tree: leaves are sha256(0x00 || transaction hash) and nodes sha256(0x01 || left || right).
+// The last node of a level with an odd count goes up to the next level as is.
+func taggedMerkleRoot(hashes [][]byte) []byte {
+
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	level := make([][]byte, len(hashes))
+	for i, h := range hashes {
+		level[i] = merkleLeaf(h)
+	}
+
+	for len(level) > 1 {
+		level = taggedMerkleLevel(level)
+	}
+
+	return level[0]
+}
+
+func taggedMerklePath(hashes [][]byte, index int) []MerkleProofStep {
+
+	level := make([][]byte, len(hashes))
+	for i, h := range hashes {
+		level[i] = merkleLeaf(h)
+	}
+
+	steps := []MerkleProofStep{}
+	for len(level) > 1 {
+
+		// The promoted node of an odd level has no sibling
+		if sibling := index ^ 1; sibling < len(level) {
+			steps = append(steps, MerkleProofStep{level[sibling], index%2 == 1})
+		}
+
+		level = taggedMerkleLevel(level)
+		index /= 2
+	}
+
+	return steps
+}
+
+func taggedMerkleLevel(level [][]byte) [][]byte {
+
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i+1 < len(level); i += 2 {
+		next = append(next, merkleNode(level[i], level[i+1]))
+	}
+	if len(level)%2 == 1 {
+		next = append(next, level[len(level)-1])
+	}
+
+	return next
+}
+
+func merkleLeaf(hash []byte) []byte {
+
+	return helpers.SHA256(append([]byte{MERKLE_LEAF_TAG}, hash...))
+}
+
+func merkleNode(left, right []byte) []byte {
+
+	buf := make([]byte, 0, 1+len(left)+len(right))
+
+	return helpers.SHA256(append(append(append(buf, MERKLE_NODE_TAG), left...), right...))
+}
+
+// Tree of BLOCK_VERSION_LEGACY_MERKLE blocks, kept to verify them. Leaves and nodes aren't
+// distinguished: pairs are combined with sha256(left || right) and the last hash of an odd list
+// is paired with the root of the ones before it.
+func legacyMerkleRoot(hashes [][]byte) []byte {
+
+	l := len(hashes)
+	if l == 0 {
+		return nil
+	}
+	if l == 1 {
+		return hashes[0]
+	}
+
+	if l%2 == 1 {
+		return legacyMerkleNode(legacyMerkleRoot(hashes[:l-1]), hashes[l-1])
+	}
+
+	bs := make([][]byte, l/2)
+	for i := range bs {
+		bs[i] = legacyMerkleNode(hashes[i*2], hashes[i*2+1])
+	}
+
+	return legacyMerkleRoot(bs)
+}
+
+func legacyMerklePath(hashes [][]byte, index int) []MerkleProofStep {
+
+	l := len(hashes)
+	if l <= 1 {
+		return []MerkleProofStep{}
+	}
+
+	if l%2 == 1 {
+
+		if index == l-1 {
+			return []MerkleProofStep{{legacyMerkleRoot(hashes[:l-1]), true}}
+		}
+		return append(legacyMerklePath(hashes[:l-1], index), MerkleProofStep{hashes[l-1], false})
+	}
+
+	bs := make([][]byte, l/2)
+	for i := range bs {
+		bs[i] = legacyMerkleNode(hashes[i*2], hashes[i*2+1])
+	}
+
+	step := MerkleProofStep{hashes[index^1], index%2 == 1}
+
+	return append([]MerkleProofStep{step}, legacyMerklePath(bs, index/2)...)
+}
+
+func legacyMerkleNode(left, right []byte) []byte {
+
+	buf := make([]byte, 0, len(left)+len(right))
+
+	return helpers.SHA256(append(append(buf, left...), right...))
+}
+
+func (b *Block) transactionHashes() [][]byte {
+
+	hashes := make([][]byte, b.TransactionSlice.Len())
+	for i := range *b.TransactionSlice {
+		hashes[i] = (*b.TransactionSlice)[i].Hash()
+	}
+
+	return hashes
+}
+
+func (b *Block) MerkleProof(index int) (*MerkleProof, error) {
+
+	hashes := b.transactionHashes()
+	if index < 0 || index >= len(hashes) {
+		return nil, ErrMerkleProofIndex
+	}
+
+	return &MerkleProof{hashes[index], uint32(index), merklePath(b.Version, hashes, index)}, nil
+}
+
+// Checks the proof against a block header we trust, its version tells which tree the proof follows
+func VerifyMerkleProof(header *BlockHeader, p *MerkleProof) bool {
+
+	if header == nil || p == nil || len(p.Hash) == 0 {
+		return false
+	}
+
+	if !merklePathMatches(header.Version, p.Index, p.Steps) {
+		return false
+	}
+
+	h, node := p.Hash, legacyMerkleNode
+	if header.Version != BLOCK_VERSION_LEGACY_MERKLE {
+		h, node = merkleLeaf(p.Hash), merkleNode
+	}
+
+	for _, s := range p.Steps {
+
+		if s.Left {
+			h = node(s.Hash, h)
+		} else {
+			h = node(h, s.Hash)
+		}
+	}
+
+	return bytes.Equal(h, header.MerkelRoot)
+}
+
+// Whether the sides of the steps are the ones of the transaction at index. The header doesn't say how many
+// transactions the block has, so the path has to fit one of the trees it can come from: the low bits of
+// the index pick the sides of the first steps, until the transaction is the last of its level.
+//
+// In the tagged tree, from there on the last node goes up as is on even positions and has a left sibling
+// on odd ones. In the legacy tree it's paired on the left with the root of the transactions before it,
+// which needs an even position, and every level above that had an odd count adds a right sibling.
+//
+// A path with no left steps only fits index 0, so the first transaction of a block can't be faked.
+func merklePathMatches(version uint32, index uint32, steps []MerkleProofStep) bool {
+
+	for k := 0; k <= len(steps); k++ {
+
+		if k > 0 && steps[k-1].Left != ((index>>uint(k-1))&1 == 1) {
+			return false
+		}
+
+		rest, position := steps[k:], uint64(index)>>uint(k)
+		if version == BLOCK_VERSION_LEGACY_MERKLE {
+
+			if position == 0 && leftSteps(rest) == 0 {
+				return true
+			}
+			if position >= 2 && position%2 == 0 && len(rest) > 0 && rest[0].Left && leftSteps(rest[1:]) == 0 {
+				return true
+			}
+
+		} else if leftSteps(rest) == len(rest) && len(rest) == bits.OnesCount64(position) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func leftSteps(steps []MerkleProofStep) int {
+
+	n := 0
+	for _, s := range steps {
+		if s.Left {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Proofs are encoded as:
+//
+//	transaction hash (32 bytes) | index (4 bytes) | step count (1 byte) | (side (1 byte) | hash (32 bytes))*
+//
+// where side is 1 when the sibling goes on the left.
+func (p *MerkleProof) MarshalBinary() ([]byte, error) {
+
+	if len(p.Steps) > MAX_MERKLE_PROOF_STEPS {
+		return nil, ErrEncodingOverrun
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(helpers.FitBytesInto(p.Hash, 32))
+	binary.Write(buf, binary.LittleEndian, p.Index)
+	buf.WriteByte(byte(len(p.Steps)))
+
+	for _, s := range p.Steps {
+
+		side := byte(0)
+		if s.Left {
+			side = 1
+		}
+		buf.WriteByte(side)
+		buf.Write(helpers.FitBytesInto(s.Hash, 32))
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (p *MerkleProof) UnmarshalBinary(d []byte) error {
+
+	if len(d) < 32+4+1 {
+		return ErrEncodingTruncated
+	}
+
+	buf := bytes.NewBuffer(d)
+	p.Hash = buf.Next(32)
+	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &p.Index)
+
+	count, _ := buf.ReadByte()
+	if int(count) > MAX_MERKLE_PROOF_STEPS {
+		return ErrEncodingOverrun
+	}
+	if buf.Len() < int(count)*33 {
+		return ErrEncodingTruncated
+	}
+	if buf.Len() > int(count)*33 {
+		return ErrEncodingOverrun
+	}
+
+	p.Steps = make([]MerkleProofStep, count)
+	for i := range p.Steps {
+
+		side, _ := buf.ReadByte()
+		if side > 1 {
+			return ErrEncodingOverrun
+		}
+		p.Steps[i] = MerkleProofStep{buf.Next(32), side == 1}
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMerkleProofs(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+
+	for _, version := range []uint32{BLOCK_VERSION_LEGACY_MERKLE, BLOCK_VERSION_TAGGED_MERKLE} {
+		for n := 1; n <= 33; n++ {
+
+			b := NewBlock(nil)
+			b.Version = version
+			for i := 0; i < n; i++ {
+				*b.TransactionSlice = append(*b.TransactionSlice, *NewTransaction(kp.Public, nil, []byte{byte(n), byte(i)}))
+			}
+			b.MerkelRoot = b.GenerateMerkelRoot()
+
+			for i := 0; i < n; i++ {
+
+				p, err := b.MerkleProof(i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !VerifyMerkleProof(b.BlockHeader, p) {
+					t.Error("Version", version, "proof for transaction", i, "of", n, "fails")
+				}
+
+				data, _ := p.MarshalBinary()
+				decoded := new(MerkleProof)
+				if err := decoded.UnmarshalBinary(data); err != nil || !reflect.DeepEqual(decoded, p) {
+					t.Error("Marshall, unmarshall proof failed", err)
+				}
+				if !VerifyMerkleProof(b.BlockHeader, decoded) {
+					t.Error("Version", version, "decoded proof for transaction", i, "of", n, "fails")
+				}
+
+				// Only the first transaction has a path that fits index 0
+				claimed := *p
+				claimed.Index = 0
+				if i > 0 && VerifyMerkleProof(b.BlockHeader, &claimed) {
+					t.Error("Version", version, "proof for transaction", i, "of", n, "passes as the first one")
+				}
+
+				if len(p.Steps) > 0 {
+					p.Steps[0].Left = !p.Steps[0].Left
+					if VerifyMerkleProof(b.BlockHeader, p) {
+						t.Error("Version", version, "tampered proof for transaction", i, "of", n, "passes")
+					}
+				}
+			}
+
+			if _, err := b.MerkleProof(n); err != ErrMerkleProofIndex {
+				t.Error("Proof for a transaction out of the block")
+			}
+		}
+	}
+}
+
+func TestMerkleProofEncodingBounds(t *testing.T) {
+
+	b := NewBlock(nil)
+	for i := 0; i < 3; i++ {
+		*b.TransactionSlice = append(*b.TransactionSlice, *NewTransaction(nil, nil, []byte{byte(i)}))
+	}
+	p, _ := b.MerkleProof(1)
+	data, _ := p.MarshalBinary()
+
+	if err := new(MerkleProof).UnmarshalBinary(data[:len(data)-1]); err != ErrEncodingTruncated {
+		t.Error("Truncated proof not rejected", err)
+	}
+	if err := new(MerkleProof).UnmarshalBinary(append(data, 0)); err != ErrEncodingOverrun {
+		t.Error("Proof with trailing data not rejected", err)
+	}
+}
@@ -11,7 +11,8 @@ type Message struct {
 	Options    []byte
 	Data       []byte
 
-	Reply chan Message
+	Reply  chan Message
+	Origin string
 }
 
 func NewMessage(id byte) *Message {
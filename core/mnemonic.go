@@ -0,0 +1,97 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var (
+	ErrMnemonicEntropy  = errors.New("Mnemonic entropy must be 16, 24 or 32 bytes")
+	ErrMnemonicWord     = errors.New("Unknown mnemonic word")
+	ErrMnemonicChecksum = errors.New("Wrong mnemonic checksum")
+)
+
+var mnemonicIndex = map[string]byte{}
+
+func init() {
+
+	for i, w := range mnemonicWords {
+		mnemonicIndex[w] = byte(i)
+	}
+}
+
+// Random mnemonic encoding entropySize bytes (16, 24 or 32)
+func NewMnemonic(entropySize int) (string, error) {
+
+	entropy := make([]byte, entropySize)
+	if _, err := rand.Read(entropy); err != nil {
+		return "", err
+	}
+
+	return EntropyToMnemonic(entropy)
+}
+
+// A mnemonic has one word per byte of entropy followed by a checksum word,
+// the first byte of sha256(entropy), so a mistyped word is noticed.
+func EntropyToMnemonic(entropy []byte) (string, error) {
+
+	if !validMnemonicEntropy(len(entropy)) {
+		return "", ErrMnemonicEntropy
+	}
+
+	checksum := sha256.Sum256(entropy)
+
+	words := make([]string, 0, len(entropy)+1)
+	for _, b := range append(append([]byte{}, entropy...), checksum[0]) {
+		words = append(words, mnemonicWords[b])
+	}
+
+	return strings.Join(words, " "), nil
+}
+
+func MnemonicToEntropy(mnemonic string) ([]byte, error) {
+
+	words := strings.Fields(strings.ToLower(mnemonic))
+	if len(words) == 0 || !validMnemonicEntropy(len(words)-1) {
+		return nil, ErrMnemonicEntropy
+	}
+
+	data := make([]byte, len(words))
+	for i, w := range words {
+
+		b, ok := mnemonicIndex[w]
+		if !ok {
+			return nil, ErrMnemonicWord
+		}
+		data[i] = b
+	}
+
+	entropy := data[:len(data)-1]
+	if checksum := sha256.Sum256(entropy); checksum[0] != data[len(data)-1] {
+		return nil, ErrMnemonicChecksum
+	}
+
+	return entropy, nil
+}
+
+// Seed for NewMasterKey. The passphrase is optional, a different one gives a different seed.
+func MnemonicToSeed(mnemonic, passphrase string) ([]byte, error) {
+
+	if _, err := MnemonicToEntropy(mnemonic); err != nil {
+		return nil, err
+	}
+
+	normalized := strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+
+	return pbkdf2.Key([]byte(normalized), []byte("mnemonic"+passphrase), MNEMONIC_PBKDF2_ROUNDS, 64, sha512.New), nil
+}
+
+func validMnemonicEntropy(size int) bool {
+
+	return size == 16 || size == 24 || size == 32
+}
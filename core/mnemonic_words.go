@@ -0,0 +1,38 @@
+package core
+
+// Mnemonic words, each one encodes a byte of the seed entropy. They are sorted and
+// all have 4 letters, so a word is never the prefix of another.
+var mnemonicWords = [256]string{
+	"able", "acid", "aged", "also", "area", "army", "away", "baby",
+	"back", "ball", "band", "bank", "base", "bath", "bear", "beat",
+	"bell", "belt", "best", "bird", "blow", "blue", "boat", "body",
+	"bone", "book", "boot", "born", "boss", "both", "bowl", "bulk",
+	"burn", "bush", "busy", "cake", "call", "calm", "camp", "card",
+	"care", "cart", "case", "cash", "cast", "cell", "chat", "chef",
+	"chip", "city", "clay", "club", "coal", "coat", "code", "coin",
+	"cold", "cook", "cool", "copy", "cord", "corn", "cost", "crew",
+	"crop", "cube", "cure", "dark", "data", "dawn", "deal", "deck",
+	"deep", "deer", "desk", "dial", "diet", "dish", "dock", "door",
+	"dose", "down", "draw", "drop", "drum", "duck", "dust", "duty",
+	"earn", "east", "easy", "edge", "else", "epic", "even", "exit",
+	"face", "fact", "fair", "fall", "farm", "fast", "fate", "fear",
+	"feed", "feel", "file", "film", "fire", "fish", "five", "flag",
+	"flat", "flow", "foam", "fold", "food", "foot", "fork", "form",
+	"fort", "four", "free", "frog", "fuel", "full", "fund", "gain",
+	"game", "gate", "gear", "gift", "girl", "give", "glad", "glow",
+	"glue", "goal", "goat", "gold", "golf", "good", "grab", "gray",
+	"grid", "grow", "gulf", "hair", "half", "hall", "hand", "hard",
+	"harm", "hawk", "head", "heat", "hero", "high", "hill", "hint",
+	"hold", "hole", "home", "hook", "hope", "horn", "host", "hour",
+	"huge", "hunt", "idea", "inch", "iron", "item", "jazz", "join",
+	"joke", "jump", "jury", "keen", "kick", "kind", "king", "kite",
+	"knee", "knot", "lake", "lamp", "land", "lane", "last", "lava",
+	"lawn", "lead", "leaf", "left", "lens", "life", "lift", "like",
+	"lime", "line", "link", "lion", "list", "live", "load", "loan",
+	"lock", "loft", "long", "loop", "lord", "loud", "love", "luck",
+	"lung", "made", "mail", "main", "malt", "many", "mark", "mask",
+	"meal", "meat", "mild", "milk", "mill", "mind", "mint", "miss",
+	"mode", "moon", "more", "moss", "move", "much", "must", "nail",
+	"name", "neck", "need", "nest", "news", "nice", "note", "oath",
+	"open", "oven", "pace", "pack", "page", "pain", "pair", "palm",
+}
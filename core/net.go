@@ -1,222 +1,525 @@
 package core
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
-
-	"github.com/izqui/helpers"
 )
 
 type ConnectionsQueue chan string
-type NodeChannel chan *Node
-type Node struct {
-	*net.TCPConn
+type PeerChannel chan *Peer
+type Peer struct {
+	// Plain TCP or the encrypted transport on top of it
+	net.Conn
 	lastSeen int
+
+	address string
+	writer  *MessageWriter
+	// Closed when the connection is
+	closed    chan bool
+	closeOnce sync.Once
+
+	// Node key the peer must announce, when we dialed it with one
+	expectedKey []byte
+
+	// Set by the handshake, the peer is ready once it sent its version and acknowledged ours
+	Version *PeerVersion
+	verack  bool
+	ready   bool
+}
+
+func NewPeer(connection net.Conn, maxFrameSize uint32) *Peer {
+
+	return &Peer{
+		Conn:     connection,
+		lastSeen: int(time.Now().Unix()),
+		address:  connection.RemoteAddr().String(),
+		writer:   NewMessageWriter(connection, maxFrameSize),
+		closed:   make(chan bool),
+	}
 }
 
-type Nodes map[string]*Node
+// A peer that doesn't take a message in PEER_WRITE_TIMEOUT is considered gone
+func (p *Peer) Send(message Message) error {
+
+	p.Conn.SetWriteDeadline(time.Now().Add(PEER_WRITE_TIMEOUT))
+	return p.writer.WriteMessage(&message)
+}
+
+func (p *Peer) Close() error {
+
+	var err error
+	p.closeOnce.Do(func() {
+		err = p.Conn.Close()
+		close(p.closed)
+	})
+
+	return err
+}
+
+type Peers map[string]*Peer
 
 type Network struct {
-	Nodes
 	ConnectionsQueue
 	Address            string
-	ConnectionCallback NodeChannel
+	ConnectionCallback PeerChannel
 	BroadcastQueue     chan Message
 	IncomingMessages   chan Message
+	MaxFrameSize       uint32
+	*AddressBook
+
+	// Connected peers by remote address, only touched with peersLock held
+	peers     Peers
+	peersLock sync.RWMutex
+
+	node     *Node
+	listener *net.TCPListener
+	// TLS configuration of the encrypted transport, nil for plain TCP
+	transport *tls.Config
+	listenCb  PeerChannel
 }
 
-func (n Nodes) AddNode(node *Node) bool {
+func (n *Network) AddPeer(ctx context.Context, p *Peer) bool {
+
+	key := p.address
+
+	n.peersLock.Lock()
+	if len(n.peers) >= MAX_NODE_CONNECTIONS {
+		n.peersLock.Unlock()
+		fmt.Println("Too many connections, dropping", key)
+		p.Close()
+		return false
+	}
+	if key == n.Address || n.peers[key] != nil {
+		n.peersLock.Unlock()
+		p.Close()
+		return false
+	}
+	n.peers[key] = p
+	n.peersLock.Unlock()
+
+	fmt.Println("Node connected", key)
+	n.AddressBook.Seen(nodeHost(key), uint32(p.lastSeen))
+
+	// Peers that don't complete the handshake in time are dropped
+	p.Conn.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	n.node.spawn(func() { n.HandlePeer(ctx, p) })
+	n.node.spawn(func() { n.sendVersion(p) })
 
-	key := node.TCPConn.RemoteAddr().String()
+	return true
+}
 
-	if key != Core.Network.Address && n[key] == nil {
+// Closes the connection and forgets the peer, so it can be connected to again
+func (n *Network) RemovePeer(p *Peer) {
 
-		fmt.Println("Node connected", key)
-		n[key] = node
+	p.Close()
 
-		go HandleNode(node)
+	n.peersLock.Lock()
+	defer n.peersLock.Unlock()
 
-		return true
+	if n.peers[p.address] == p {
+		delete(n.peers, p.address)
+		fmt.Println("Node disconnected", p.address)
 	}
-	return false
 }
 
-func HandleNode(node *Node) {
+// Reads messages from the peer until its connection fails or is closed when the node stops.
+// Only handshake messages are accepted until the handshake is done, and never again after.
+func (n *Network) HandlePeer(ctx context.Context, p *Peer) {
 
-	for {
-		var bs []byte = make([]byte, 1024*1000)
-		n, err := node.TCPConn.Read(bs[0:])
-		networkError(err)
+	defer n.RemovePeer(p)
 
-		if err == io.EOF {
-			fmt.Println("EOF")
-			//TODO: Remove node [Issue: https://github.com/izqui/blockchain/issues/3]
-			node.TCPConn.Close()
-			break
+	// Whoever connects can make us allocate a frame, so it stays small until the peer is known
+	reader := NewMessageReader(p.Conn, MAX_HANDSHAKE_FRAME_SIZE)
+	for {
+		m, err := reader.ReadMessage()
+		if err != nil {
+			// After a corrupt or oversized frame the stream can't be trusted anymore
+			if ctx.Err() == nil {
+				networkError(err)
+			}
+			return
 		}
 
-		m := new(Message)
-		err = m.UnmarshalBinary(bs[0:n])
+		p.lastSeen = int(time.Now().Unix())
+		n.AddressBook.Seen(nodeHost(p.address), uint32(p.lastSeen))
 
-		if err != nil {
-			fmt.Println(err)
+		if !p.ready || m.Identifier == MESSAGE_VERSION || m.Identifier == MESSAGE_VERACK {
+			if err := n.handshake(p, m); err != nil {
+				fmt.Println("Handshake with", p.address, "failed:", err)
+				return
+			}
+			if p.ready {
+				reader.MaxFrameSize = n.MaxFrameSize
+			}
 			continue
 		}
 
 		m.Reply = make(chan Message)
+		m.Origin = p.address
 
-		go func(cb chan Message) {
-			for {
-				m, ok := <-cb
+		cb := m.Reply
+		n.node.spawn(func() {
+			for m := range cb {
+				n.send(p, m)
+			}
+		})
 
-				if !ok {
-					close(cb)
-					break
-				}
+		select {
+		case n.IncomingMessages <- *m:
+		case <-ctx.Done():
+			closeReply(*m)
+			return
+		}
+	}
+}
 
-				b, _ := m.MarshalBinary()
-				l := len(b)
+func (n *Network) isReady(p *Peer) bool {
 
-				i := 0
-				for i < l {
+	n.peersLock.RLock()
+	defer n.peersLock.RUnlock()
 
-					a, _ := node.TCPConn.Write(b[i:])
-					i += a
-				}
-			}
+	return p.ready
+}
 
-		}(m.Reply)
+// Sends to a connected peer, which is dropped if the connection fails
+func (n *Network) send(p *Peer, message Message) error {
 
-		Core.Network.IncomingMessages <- *m
+	err := p.Send(message)
+	if err != nil && err != ErrFrameTooLarge {
+		networkError(err)
+		n.RemovePeer(p)
 	}
+
+	return err
+}
+
+// Connection to address, whether its handshake is done or not
+func (n *Network) Peer(address string) *Peer {
+
+	n.peersLock.RLock()
+	defer n.peersLock.RUnlock()
+
+	return n.peers[address]
 }
 
-func SetupNetwork(address, port string) *Network {
+// Number of peers that completed the handshake
+func (n *Network) PeerCount() int {
+
+	return len(n.peerList())
+}
+
+// Remote addresses of the peers that completed the handshake
+func (n *Network) PeerAddresses() []string {
+
+	ps := n.peerList()
+	as := make([]string, 0, len(ps))
+	for _, p := range ps {
+		as = append(as, p.address)
+	}
+	sort.Strings(as)
+
+	return as
+}
+
+// Peers that completed the handshake
+func (n *Network) peerList() []*Peer {
+
+	n.peersLock.RLock()
+	defer n.peersLock.RUnlock()
+
+	ps := make([]*Peer, 0, len(n.peers))
+	for _, p := range n.peers {
+		if p.ready {
+			ps = append(ps, p)
+		}
+	}
+
+	return ps
+}
+
+func SetupNetwork(node *Node, address string) *Network {
 
 	n := new(Network)
 
+	n.node = node
 	n.BroadcastQueue, n.IncomingMessages = make(chan Message), make(chan Message)
-	n.ConnectionsQueue, n.ConnectionCallback = CreateConnectionsQueue()
-	n.Nodes = Nodes{}
-	n.Address = address //fmt.Sprintf("%s:%s", address, port)
+	n.ConnectionsQueue, n.ConnectionCallback = make(ConnectionsQueue), make(PeerChannel)
+	n.peers = Peers{}
+	n.Address = address
+	n.MaxFrameSize = node.options.MaxFrameSize
+	n.AddressBook = NewAddressBook()
 
 	return n
 }
 
-func (n *Network) Run() {
+func (n *Network) Listen(ctx context.Context) error {
+
+	if n.node.options.EncryptTransport {
+
+		kp, err := n.node.SigningKeypair()
+		if err != nil {
+			return err
+		}
+		if n.transport, err = newTransportConfig(kp); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("Listening in", n.Address)
+
+	cb, err := n.StartListening(ctx, n.Address)
+	if err != nil {
+		return err
+	}
+	n.listenCb = cb
+
+	return nil
+}
+
+// Handles new peers and broadcasts until ctx is done, then closes the listener and every peer connection
+func (n *Network) Run(ctx context.Context) {
 
-	fmt.Println("Listening in", Core.Address)
-	listenCb := StartListening(Core.Address)
+	n.node.spawn(func() { n.processConnectionsQueue(ctx) })
+	exchange := time.NewTicker(PEER_EXCHANGE_INTERVAL)
+	defer exchange.Stop()
 
 	for {
 		select {
-		case node := <-listenCb:
-			Core.Nodes.AddNode(node)
+		case p := <-n.listenCb:
+			n.AddPeer(ctx, p)
 
-		case node := <-n.ConnectionCallback:
-			Core.Nodes.AddNode(node)
+		case p := <-n.ConnectionCallback:
+			n.AddPeer(ctx, p)
 
 		case message := <-n.BroadcastQueue:
-			go n.BroadcastMessage(message)
+			n.node.spawn(func() { n.BroadcastMessage(message) })
+
+		case <-exchange.C:
+			n.AddressBook.Prune()
+			n.node.spawn(func() { n.BroadcastMessage(*NewMessage(MESSAGE_GET_NODES)) })
+			n.node.spawn(n.ConnectToKnownAddresses)
+
+		case <-ctx.Done():
+			n.Close()
+			return
 		}
 	}
 }
 
-func CreateConnectionsQueue() (ConnectionsQueue, NodeChannel) {
+// Closes the listener and every peer connection
+func (n *Network) Close() {
+
+	if n.listener != nil {
+		n.listener.Close()
+	}
+
+	n.peersLock.RLock()
+	defer n.peersLock.RUnlock()
+
+	for _, p := range n.peers {
+		p.Close()
+	}
+}
+
+// Adds peers from the address book to the connections queue until MAX_NODE_CONNECTIONS
+func (n *Network) ConnectToKnownAddresses() {
 
-	in := make(ConnectionsQueue)
-	out := make(NodeChannel)
+	missing := MAX_NODE_CONNECTIONS - n.PeerCount()
+	if missing <= 0 {
+		return
+	}
 
-	go func() {
+	connected := map[string]bool{nodeHost(n.Address): true}
+	for _, k := range n.PeerAddresses() {
+		connected[nodeHost(k)] = true
+	}
 
-		for {
-			address := <-in
+	for _, a := range n.AddressBook.Addresses(MAX_ADDRESS_BOOK_SIZE) {
+
+		if missing == 0 {
+			break
+		}
+		if !connected[a.Address] {
+			n.ConnectionsQueue <- a.Address
+			missing--
+		}
+	}
+}
+
+func (n *Network) processConnectionsQueue(ctx context.Context) {
+
+	for {
+		select {
+		case address := <-n.ConnectionsQueue:
 
-			address = fmt.Sprintf("%s:%s", address, BLOCKCHAIN_PORT)
+			address = net.JoinHostPort(address, BLOCKCHAIN_PORT)
 
-			if address != Core.Network.Address && Core.Nodes[address] == nil {
+			if address != n.Address && n.Peer(address) == nil && n.PeerCount() < MAX_NODE_CONNECTIONS {
 
-				go ConnectToNode(address, 5*time.Second, false, out)
+				n.node.spawn(func() { n.ConnectToPeer(ctx, address, PEER_DIAL_TIMEOUT, false, n.ConnectionCallback) })
 			}
-		}
-	}()
 
-	return in, out
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
-func StartListening(address string) NodeChannel {
+// Accepts connections until ctx is done
+func (n *Network) StartListening(ctx context.Context, address string) (PeerChannel, error) {
 
-	cb := make(NodeChannel)
+	cb := make(PeerChannel)
 	addr, err := net.ResolveTCPAddr("tcp4", address)
-	networkError(err)
+	if err != nil {
+		return nil, err
+	}
 
 	listener, err := net.ListenTCP("tcp4", addr)
-	networkError(err)
+	if err != nil {
+		return nil, err
+	}
+	n.listener = listener
 
-	go func(l *net.TCPListener) {
+	n.node.spawn(func() {
 
 		for {
-			connection, err := l.AcceptTCP()
-			networkError(err)
+			connection, err := listener.AcceptTCP()
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				networkError(err)
+				continue
+			}
 
-			cb <- &Node{connection, int(time.Now().Unix())}
+			cb <- NewPeer(n.wrapConnection(connection, true), n.MaxFrameSize)
 		}
+	})
 
-	}(listener)
-
-	return cb
+	return cb, nil
 }
 
-func ConnectToNode(dst string, timeout time.Duration, retry bool, cb NodeChannel) {
+// Dials dst and hands the connection to cb. Without retry it gives up after the first attempt,
+// otherwise it tries again every timeout until ctx is done.
+func (n *Network) ConnectToPeer(ctx context.Context, dst string, timeout time.Duration, retry bool, cb PeerChannel) {
 
-	addrDst, err := net.ResolveTCPAddr("tcp4", dst)
-	networkError(err)
+	for {
+
+		if p := n.dial(ctx, dst, timeout); p != nil {
+			cb <- p
+			return
+		}
 
-	var con *net.TCPConn = nil
-loop:
+		if !retry {
+			return
+		}
+		select {
+		case <-time.After(timeout):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Connects to address and connects again every time the connection drops, until ctx is done.
+// Failed attempts wait twice as long as the previous one, from PEER_RECONNECT_MIN_DELAY up to
+// PEER_RECONNECT_MAX_DELAY, and a connection that lasted longer than that starts over.
+// With a key, the handshake fails unless the peer has that node key.
+func (n *Network) KeepConnected(ctx context.Context, address string, key []byte) {
+
+	delay := PEER_RECONNECT_MIN_DELAY
 	for {
 
-		breakChannel := make(chan bool)
-		go func() {
+		if p := n.dial(ctx, address, PEER_DIAL_TIMEOUT); p != nil {
 
-			con, err = net.DialTCP("tcp", nil, addrDst)
+			p.expectedKey = key
 
-			if con != nil {
+			select {
+			case n.ConnectionCallback <- p:
+			case <-ctx.Done():
+				p.Close()
+				return
+			}
 
-				cb <- &Node{con, int(time.Now().Unix())}
-				breakChannel <- true
+			connected := time.Now()
+			select {
+			case <-p.closed:
+			case <-ctx.Done():
+				return
+			}
+			if time.Since(connected) > PEER_RECONNECT_MAX_DELAY {
+				delay = PEER_RECONNECT_MIN_DELAY
 			}
-		}()
+		}
 
 		select {
-		case <-helpers.Timeout(timeout):
-			if !retry {
-				break loop
-			}
-		case <-breakChannel:
-			break loop
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
 		}
+		delay = nextReconnectDelay(delay)
+	}
+}
+
+// Configured peers can be written as address@key to pin the node key they must have
+func splitPeerKey(peer string) (string, []byte) {
 
+	if i := strings.LastIndex(peer, "@"); i >= 0 {
+		return peer[:i], []byte(peer[i+1:])
 	}
+
+	return peer, nil
+}
+
+func nextReconnectDelay(delay time.Duration) time.Duration {
+
+	if delay *= 2; delay > PEER_RECONNECT_MAX_DELAY {
+		return PEER_RECONNECT_MAX_DELAY
+	}
+
+	return delay
+}
+
+// Nil if dst can't be reached in timeout or ctx is done first
+func (n *Network) dial(ctx context.Context, dst string, timeout time.Duration) *Peer {
+
+	dialer := net.Dialer{Timeout: timeout}
+	con, err := dialer.DialContext(ctx, "tcp", dst)
+	if err != nil {
+		if ctx.Err() == nil {
+			networkError(err)
+		}
+		return nil
+	}
+
+	return NewPeer(n.wrapConnection(con, false), n.MaxFrameSize)
 }
 
 func (n *Network) BroadcastMessage(message Message) {
 
-	b, _ := message.MarshalBinary()
+	for _, p := range n.peerList() {
+		p := p
+		n.node.spawn(func() { n.send(p, message) })
+	}
+}
 
-	for k, node := range n.Nodes {
-		fmt.Println("Broadcasting...", k)
-		go func() {
-			_, err := node.TCPConn.Write(b)
-			if err != nil {
-				fmt.Println("Error bcing to", node.TCPConn.RemoteAddr())
-			}
-		}()
+func (n *Network) SendTo(address string, message Message) error {
+
+	p := n.Peer(address)
+	if p == nil || !n.isReady(p) {
+		return fmt.Errorf("Node %s is not connected", address)
 	}
+
+	return n.send(p, message)
 }
 
 func GetIpAddress() []string {
@@ -236,6 +539,16 @@ func GetIpAddress() []string {
 	return addrs
 }
 
+func nodeHost(address string) string {
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	return host
+}
+
 func networkError(err error) {
 
 	if err != nil && err != io.EOF {
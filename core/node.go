@@ -0,0 +1,434 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// A blockchain node: it owns its chain, its connections to peers and the keypair it mines and signs with.
+// Several nodes can live in the same process.
+type Node struct {
+	*Keypair
+	*Blockchain
+	*Network
+	*Syncer
+	// Only set for light nodes
+	*SPVClient
+
+	options NodeOptions
+	cancel  context.CancelFunc
+	// Long-running goroutines, Stop waits for all of them
+	routines sync.WaitGroup
+}
+
+type NodeOptions struct {
+	// Either a plain keypair or an account of a keystore, which must be unlocked for the node to
+	// start and to create transactions
+	Keypair  *Keypair
+	Keystore *Keystore
+	Account  string
+
+	// Public facing ip:port the node listens on
+	Address string
+	// Hosts connected to on start, they are expected to listen in BLOCKCHAIN_PORT
+	Seeds []string
+	// ip:port of peers to stay connected to. Like the seeds, they are connected to again when the
+	// connection drops.
+	// Seeds and peers written as address@key must announce that node key, which with EncryptTransport
+	// keeps anyone in between from standing in for them.
+	PersistentPeers []string
+
+	// Keeps the chain only in memory when nil
+	Store *BlockStore
+
+	// Light nodes only keep block headers and don't mine. They get the transactions addressed
+	// to their keys from full peers with merkel proofs.
+	Light bool
+
+	TransactionPow []byte
+	// Difficulty rules, DefaultConsensusParams when zero
+	Consensus ConsensusParams
+
+	// Largest frame read from a peer once the handshake is done, MaxFrameSize(Consensus) when zero
+	MaxFrameSize uint32
+	// Peers with a different magic in their handshake are on another network, MESSAGE_MAGIC when zero
+	NetworkMagic uint32
+	// Sent to peers in the handshake, USER_AGENT when empty
+	UserAgent string
+	// Encrypt peer connections with TLS, authenticated with the node keypair. Every node of the
+	// network needs it.
+	EncryptTransport bool
+	// Goroutines verifying the transactions of a block, the number of CPUs when zero
+	VerifyWorkers int
+}
+
+var (
+	ErrNodeRunning      = errors.New("Node is already running")
+	ErrInvalidRecipient = errors.New("Recipient isn't a public key")
+	ErrInvalidPeerKey   = errors.New("Configured peer key isn't a public key")
+)
+
+func NewNode(options NodeOptions) (*Node, error) {
+
+	if options.Keypair == nil && options.Keystore == nil {
+		return nil, errors.New("A keypair or a keystore account is required")
+	}
+	if options.TransactionPow == nil {
+		options.TransactionPow = TRANSACTION_POW
+	}
+	if options.Consensus == (ConsensusParams{}) {
+		options.Consensus = DefaultConsensusParams()
+	}
+	if options.Consensus.BlockInterval < time.Second {
+		return nil, ErrBlockIntervalTooShort
+	}
+	if options.MaxFrameSize == 0 {
+		options.MaxFrameSize = MaxFrameSize(options.Consensus)
+	}
+	if options.NetworkMagic == 0 {
+		options.NetworkMagic = MESSAGE_MAGIC
+	}
+	if options.UserAgent == "" {
+		options.UserAgent = USER_AGENT
+	}
+	for _, peer := range append(append([]string{}, options.Seeds...), options.PersistentPeers...) {
+		if _, key := splitPeerKey(peer); key != nil && !ValidPublicKey(key) {
+			return nil, ErrInvalidPeerKey
+		}
+	}
+	if options.VerifyWorkers <= 0 {
+		options.VerifyWorkers = runtime.NumCPU()
+	}
+
+	node := &Node{Keypair: options.Keypair, options: options}
+
+	// Only the public key is kept around, signing goes through the keystore
+	if options.Keystore != nil {
+
+		public, err := options.Keystore.Public(options.Account)
+		if err != nil {
+			return nil, err
+		}
+		node.Keypair = &Keypair{Public: public}
+	}
+
+	var err error
+	node.Blockchain, err = SetupBlockchan(node, options.Store)
+	if err != nil {
+		return nil, err
+	}
+	node.Network = SetupNetwork(node, options.Address)
+	node.Syncer = NewSyncer(node)
+	if options.Light {
+		node.SPVClient = NewSPVClient(node)
+	}
+
+	return node, nil
+}
+
+// Starts listening, connects to the seeds and runs the node until ctx is done or Stop is called
+func (node *Node) Start(ctx context.Context) error {
+
+	if node.cancel != nil {
+		return ErrNodeRunning
+	}
+
+	// Full nodes sign the blocks they mine
+	if !node.options.Light {
+		if _, err := node.SigningKeypair(); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	if err := node.Network.Listen(ctx); err != nil {
+		cancel()
+		return err
+	}
+	node.cancel = cancel
+
+	node.spawn(func() { node.Network.Run(ctx) })
+	for _, seed := range node.options.Seeds {
+		host, key := splitPeerKey(seed)
+		address := net.JoinHostPort(host, BLOCKCHAIN_PORT)
+		node.spawn(func() { node.Network.KeepConnected(ctx, address, key) })
+	}
+	for _, peer := range node.options.PersistentPeers {
+		address, key := splitPeerKey(peer)
+		node.spawn(func() { node.Network.KeepConnected(ctx, address, key) })
+	}
+
+	node.spawn(func() { node.Blockchain.Run(ctx) })
+	node.spawn(func() { node.Syncer.Run(ctx) })
+
+	node.spawn(func() {
+		for {
+			select {
+			case msg := <-node.Network.IncomingMessages:
+				node.HandleIncomingMessage(msg)
+				closeReply(msg)
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+// Stops the node and returns once all its goroutines are done: the listener and the peer connections
+// are closed, whatever is left in the queues is dropped and the block store is flushed.
+func (node *Node) Stop() {
+
+	if node.cancel == nil {
+		return
+	}
+	node.cancel()
+
+	stopped := make(chan bool)
+	go func() {
+		node.routines.Wait()
+		close(stopped)
+	}()
+	node.drainQueues(stopped)
+
+	if node.options.Store != nil {
+		if err := node.options.Store.Sync(); err != nil {
+			log.Println("Flushing block store:", err)
+		}
+	}
+}
+
+// Runs f in a goroutine Stop waits for
+func (node *Node) spawn(f func()) {
+
+	node.routines.Add(1)
+	go func() {
+		defer node.routines.Done()
+		f()
+	}()
+}
+
+// Takes from the queues until stopped is closed, so goroutines handing something to a loop that
+// already returned can finish
+func (node *Node) drainQueues(stopped chan bool) {
+
+	n := node.Network
+	for {
+		select {
+		case <-node.Blockchain.TransactionsQueue:
+		case <-node.Blockchain.BlocksQueue:
+		case <-n.BroadcastQueue:
+		case <-n.ConnectionsQueue:
+		case msg := <-n.IncomingMessages:
+			closeReply(msg)
+		case p := <-n.ConnectionCallback:
+			p.Close()
+		case p := <-n.listenCb:
+			p.Close()
+		case <-stopped:
+			return
+		}
+	}
+}
+
+// Nothing else is sent to the peer in reply to msg
+func closeReply(msg Message) {
+
+	if msg.Reply != nil {
+		close(msg.Reply)
+	}
+}
+
+// Keypair the node signs with, it fails while the keystore account is locked
+func (node *Node) SigningKeypair() (*Keypair, error) {
+
+	if node.options.Keystore != nil {
+		return node.options.Keystore.Keypair(node.options.Account)
+	}
+
+	return node.options.Keypair, nil
+}
+
+// Transaction from the node keypair to the public key to, nil sends it to nobody
+func (node *Node) CreateTransaction(to []byte, txt string) (*Transaction, error) {
+
+	kp, err := node.SigningKeypair()
+	if err != nil {
+		return nil, err
+	}
+
+	return node.CreateTransactionFrom(kp, to, []byte(txt))
+}
+
+// Transaction moving amount from the node key to the public key to in ledger chains, paying fee
+// to the miner. EstimateFee gives a fee that got transactions into recent blocks.
+func (node *Node) CreateTransfer(to []byte, amount, fee uint64, txt string) (*Transaction, error) {
+
+	kp, err := node.SigningKeypair()
+	if err != nil {
+		return nil, err
+	}
+
+	return node.CreateTransferFrom(kp, to, amount, fee, []byte(txt))
+}
+
+// Transaction signed by someone else's keypair, with the proof of work this node requires
+func (node *Node) CreateTransactionFrom(keypair *Keypair, to, payload []byte) (*Transaction, error) {
+
+	return node.CreateTransferFrom(keypair, to, 0, 0, payload)
+}
+
+// In ledger chains the transaction takes the next sequence number of the keypair, counting the
+// ones waiting in the mempool
+func (node *Node) CreateTransferFrom(keypair *Keypair, to []byte, amount, fee uint64, payload []byte) (*Transaction, error) {
+
+	if to != nil && !ValidPublicKey(to) {
+		return nil, ErrInvalidRecipient
+	}
+	if amount > 0 && to == nil {
+		return nil, ErrNoRecipient
+	}
+
+	t := NewTransaction(keypair.Public, to, payload)
+	t.Header.Amount = amount
+	t.Header.Fee = fee
+	t.Header.Sequence = node.Blockchain.NextSequence(keypair.Public)
+	t.Header.Nonce = t.GenerateNonce(node.options.TransactionPow)
+	t.Signature = t.Sign(keypair)
+
+	return t, nil
+}
+
+func (node *Node) HandleIncomingMessage(msg Message) {
+
+	switch msg.Identifier {
+	case MESSAGE_SEND_TRANSACTION:
+		t := new(Transaction)
+		_, err := t.UnmarshalBinary(msg.Data)
+		if err != nil {
+			networkError(err)
+			break
+		}
+		node.Blockchain.TransactionsQueue <- t
+
+	case MESSAGE_SEND_BLOCK:
+		b := new(Block)
+		err := b.UnmarshalBinary(msg.Data)
+		if err != nil {
+			networkError(err)
+			break
+		}
+		node.Syncer.BlockReceived(b.Hash())
+		node.Blockchain.BlocksQueue <- QueuedBlock{*b, msg.Origin}
+
+	case MESSAGE_GET_NODES:
+		reply := NewMessage(MESSAGE_SEND_NODES)
+		reply.Data = MarshalAddresses(node.Network.AddressBook.Addresses(MAX_NODES_PER_MESSAGE))
+		msg.Reply <- *reply
+
+	case MESSAGE_SEND_NODES:
+		addresses, err := UnmarshalAddresses(msg.Data)
+		if err != nil {
+			networkError(err)
+			break
+		}
+
+		for _, a := range addresses {
+			if node.Network.AddressBook.Seen(a.Address, a.LastSeen) && node.Network.PeerCount() < MAX_NODE_CONNECTIONS {
+				node.Network.ConnectionsQueue <- a.Address
+			}
+		}
+
+	case MESSAGE_GET_BLOCK:
+		// Light nodes only have headers to give
+		if node.options.Light {
+			break
+		}
+
+		hashes, err := UnmarshalHashes(msg.Data)
+		if err != nil {
+			networkError(err)
+			break
+		}
+		if len(hashes) > MAX_BLOCKS_PER_REQUEST {
+			hashes = hashes[:MAX_BLOCKS_PER_REQUEST]
+		}
+
+		for _, h := range hashes {
+			if b := node.Blockchain.GetBlock(h); b != nil {
+
+				reply := NewMessage(MESSAGE_SEND_BLOCK)
+				reply.Data, _ = b.MarshalBinary()
+				msg.Reply <- *reply
+			}
+		}
+
+	case MESSAGE_GET_HEADERS:
+		locator, err := UnmarshalHashes(msg.Data)
+		if err != nil {
+			networkError(err)
+			break
+		}
+
+		reply := NewMessage(MESSAGE_SEND_HEADERS)
+		reply.Data = MarshalHeaders(node.Blockchain.HeadersAfter(locator, MAX_HEADERS_PER_MESSAGE))
+		msg.Reply <- *reply
+
+	case MESSAGE_SEND_HEADERS:
+		headers, err := UnmarshalHeaders(msg.Data)
+		if err != nil {
+			networkError(err)
+			break
+		}
+		node.Syncer.HandleHeaders(msg.Origin, headers)
+
+	case MESSAGE_GET_MERKLE_PROOFS:
+		if node.options.Light {
+			break
+		}
+
+		key, blocks, err := UnmarshalProofsRequest(msg.Data)
+		if err != nil {
+			networkError(err)
+			break
+		}
+		if len(blocks) > MAX_HEADERS_PER_MESSAGE {
+			blocks = blocks[:MAX_HEADERS_PER_MESSAGE]
+		}
+
+		proofs := node.Blockchain.ProofsFor(key, blocks)
+		for _, h := range blocks {
+
+			ts := proofs[string(h)]
+			if len(ts) == 0 {
+				continue
+			}
+			delete(proofs, string(h))
+
+			reply := NewMessage(MESSAGE_SEND_MERKLE_PROOFS)
+			if reply.Data, err = MarshalProofs(h, ts); err != nil {
+				networkError(err)
+				continue
+			}
+			msg.Reply <- *reply
+		}
+
+	case MESSAGE_SEND_MERKLE_PROOFS:
+		if !node.options.Light {
+			break
+		}
+
+		block, ts, err := UnmarshalProofs(msg.Data)
+		if err != nil {
+			networkError(err)
+			break
+		}
+		node.SPVClient.HandleProofs(msg.Origin, block, ts)
+	}
+}
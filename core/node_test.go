@@ -0,0 +1,167 @@
+package core
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func freeLocalAddress() string {
+
+	l, _ := net.Listen("tcp4", "127.0.0.1:0")
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+func TestTwoNodesInOneProcess(t *testing.T) {
+
+	// Both nodes are on the network of the same genesis block, otherwise each would mine its own
+	kp := GenerateNewKeypair()
+	genesis := newTestBlock(kp, nil)
+	params := DefaultConsensusParams()
+	copy(params.GenesisHash[:], genesis.Hash())
+
+	a, _ := NewNode(NodeOptions{Keypair: kp, Address: freeLocalAddress(), Consensus: params})
+	b, _ := NewNode(NodeOptions{Keypair: GenerateNewKeypair(), Address: freeLocalAddress(), Consensus: params})
+
+	for _, n := range []*Node{a, b} {
+		if err := n.Blockchain.AddBlock(genesis); err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		defer n.Stop()
+	}
+
+	if err := a.Start(context.Background()); err != ErrNodeRunning {
+		t.Error("Node started twice")
+	}
+
+	go b.Network.ConnectToPeer(context.Background(), a.Network.Address, 5*time.Second, false, b.Network.ConnectionCallback)
+
+	// Wait for the connection before a mines, so the block gets broadcasted to b
+	for i := 0; i < 100 && a.Network.PeerCount() == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	tr, err := a.CreateTransaction(nil, "hola")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Blockchain.TransactionsQueue <- tr
+
+	for i := 0; i < 200; i++ {
+
+		if tip := a.Blockchain.Tip(); tip != nil && b.Blockchain.HasBlock(tip.Hash()) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Error("Block mined by a never reached b")
+}
+
+func TestNodeStop(t *testing.T) {
+
+	before := runtime.NumGoroutine()
+
+	a, _ := NewNode(NodeOptions{Keypair: GenerateNewKeypair(), Address: freeLocalAddress()})
+	b, _ := NewNode(NodeOptions{Keypair: GenerateNewKeypair(), Address: freeLocalAddress()})
+	for _, n := range []*Node{a, b} {
+		if err := n.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b.Network.ConnectionsQueue <- "127.0.0.1"
+	go b.Network.ConnectToPeer(context.Background(), a.Network.Address, 5*time.Second, false, b.Network.ConnectionCallback)
+	for i := 0; i < 100 && a.Network.PeerCount() == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	stopped := make(chan bool)
+	go func() {
+		a.Stop()
+		b.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop didn't return")
+	}
+
+	if c, err := net.Dial("tcp4", a.Network.Address); err == nil {
+		c.Close()
+		t.Error("Listener still open after Stop")
+	}
+
+	// Short lived goroutines, like the ones sending to a closed peer, may take a moment to return
+	for i := 0; i < 50 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Error("Goroutines left after Stop", n, before)
+	}
+}
+
+func TestPeerReconnects(t *testing.T) {
+
+	a, _ := NewNode(NodeOptions{Keypair: GenerateNewKeypair(), Address: freeLocalAddress()})
+	b, _ := NewNode(NodeOptions{Keypair: GenerateNewKeypair(), Address: freeLocalAddress(), PersistentPeers: []string{a.Network.Address}})
+
+	waitPeers := func(n *Node, count int) bool {
+		for i := 0; i < 100; i++ {
+			if n.Network.PeerCount() == count {
+				return true
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return false
+	}
+
+	// b keeps trying until a is up
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+	time.Sleep(100 * time.Millisecond)
+	if err := a.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+
+	if !waitPeers(a, 1) || !waitPeers(b, 1) {
+		t.Fatal("Persistent peer not connected", a.Network.PeerCount(), b.Network.PeerCount())
+	}
+
+	// a drops the connection, both forget the peer and b connects again
+	first := a.Network.PeerAddresses()[0]
+	a.Network.RemovePeer(a.Network.Peer(first))
+	if !waitPeers(b, 0) {
+		t.Error("Closed connection still in the peers of b")
+	}
+	if !waitPeers(a, 1) || a.Network.PeerAddresses()[0] == first {
+		t.Error("Persistent peer didn't reconnect", a.Network.PeerAddresses())
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+
+	delay := PEER_RECONNECT_MIN_DELAY
+	for i := 0; i < 20; i++ {
+		next := nextReconnectDelay(delay)
+		if next != 2*delay && next != PEER_RECONNECT_MAX_DELAY {
+			t.Fatal("Delay doesn't double", delay, next)
+		}
+		delay = next
+	}
+
+	if delay != PEER_RECONNECT_MAX_DELAY {
+		t.Error("Delay not capped", delay)
+	}
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"math/big"
 	"reflect"
 
 	"github.com/izqui/helpers"
@@ -8,10 +9,8 @@ import (
 
 var (
 	TRANSACTION_POW = helpers.ArrayOfBytes(TRANSACTION_POW_COMPLEXITY, POW_PREFIX)
-	BLOCK_POW       = helpers.ArrayOfBytes(BLOCK_POW_COMPLEXITY, POW_PREFIX)
 
 	TEST_TRANSACTION_POW = helpers.ArrayOfBytes(TEST_TRANSACTION_POW_COMPLEXITY, POW_PREFIX)
-	TEST_BLOCK_POW       = helpers.ArrayOfBytes(TEST_BLOCK_POW_COMPLEXITY, POW_PREFIX)
 )
 
 func CheckProofOfWork(prefix []byte, hash []byte) bool {
@@ -21,3 +20,58 @@ func CheckProofOfWork(prefix []byte, hash []byte) bool {
 	}
 	return true
 }
+
+// Block targets are 256 bit numbers encoded in 4 bytes (as bitcoin's nBits):
+// the size in bytes of the target followed by its 3 most significant bytes.
+// A block hash, read as a big endian number, must be lower or equal than its target.
+func CompactToTarget(bits uint32) *big.Int {
+
+	size := uint(bits >> 24)
+	t := big.NewInt(int64(bits & 0x007fffff))
+
+	if size <= 3 {
+		return t.Rsh(t, 8*(3-size))
+	}
+
+	return t.Lsh(t, 8*(size-3))
+}
+
+func TargetToCompact(t *big.Int) uint32 {
+
+	size := uint(len(t.Bytes()))
+
+	var mantissa uint32
+	if size <= 3 {
+		mantissa = uint32(t.Uint64() << (8 * (3 - size)))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(t, 8*(size-3)).Uint64())
+	}
+
+	// The top bit of the mantissa is a sign bit in bitcoin's encoding, keep it clear
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		size++
+	}
+
+	return uint32(size)<<24 | mantissa
+}
+
+func CheckProofOfWorkTarget(bits uint32, hash []byte) bool {
+
+	target := CompactToTarget(bits)
+
+	return target.Sign() > 0 && new(big.Int).SetBytes(hash).Cmp(target) <= 0
+}
+
+// Expected number of hashes to find a block with the target: 2^256 / (target + 1)
+func WorkForTarget(bits uint32) *big.Int {
+
+	target := CompactToTarget(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+
+	max := new(big.Int).Lsh(big.NewInt(1), 256)
+
+	return max.Div(max, target.Add(target, big.NewInt(1)))
+}
@@ -8,10 +8,35 @@ func TestPow(t *testing.T) {
 
 	b1 := CheckProofOfWork([]byte{0, 0, 0, 1, 2, 3}, []byte{0, 0, 0, 1, 2, 3, 4, 5})
 	b2 := CheckProofOfWork([]byte{0, 0}, []byte("hola"))
-	b3 := CheckProofOfWork(BLOCK_POW, append(BLOCK_POW, 1))
+	b3 := CheckProofOfWork(TRANSACTION_POW, append(TRANSACTION_POW, 1))
 	b4 := CheckProofOfWork(nil, []byte("hola que tal"))
 
 	if !b1 || b2 || !b3 || !b4 {
 		t.Error("Proof of work test fails.")
 	}
 }
+
+func TestCompactTarget(t *testing.T) {
+
+	for _, bits := range []uint32{BLOCK_POW_LIMIT_BITS, 0x1d00ffff, 0x1b0404cb, 0x03123456} {
+
+		if TargetToCompact(CompactToTarget(bits)) != bits {
+			t.Errorf("Compact target %x doesn't round trip", bits)
+		}
+	}
+
+	hash := make([]byte, 32)
+	hash[2] = 0xff
+	if !CheckProofOfWorkTarget(BLOCK_POW_LIMIT_BITS, hash) {
+		t.Error("Hash under the target fails")
+	}
+
+	hash[1] = 1
+	if CheckProofOfWorkTarget(BLOCK_POW_LIMIT_BITS, hash) {
+		t.Error("Hash over the target passes")
+	}
+
+	if WorkForTarget(0x1e00ffff).Cmp(WorkForTarget(BLOCK_POW_LIMIT_BITS)) <= 0 {
+		t.Error("Harder target should mean more work")
+	}
+}
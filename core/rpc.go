@@ -0,0 +1,644 @@
+package core
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+
+	"github.com/tv42/base58"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	RPC_PARSE_ERROR      = -32700
+	RPC_INVALID_REQUEST  = -32600
+	RPC_METHOD_NOT_FOUND = -32601
+	RPC_INVALID_PARAMS   = -32602
+	RPC_INTERNAL_ERROR   = -32603
+	RPC_NOT_FOUND        = -32000
+	RPC_UNAUTHORIZED     = -32001
+)
+
+var (
+	ErrRPCNotFound     = &RPCError{RPC_NOT_FOUND, "Not found"}
+	ErrRPCUnauthorized = &RPCError{RPC_UNAUTHORIZED, "Signing with the node key needs the RPC token"}
+)
+
+// HTTP JSON-RPC 2.0 interface to a node. Every call is a POST with a single request:
+//
+//	{"jsonrpc": "2.0", "method": "getBlock", "params": {"height": 0}, "id": 1}
+//
+// Hashes go hex encoded, keys and signatures as their base58 strings and payloads in base64.
+// Only JSON requests to a loopback host without an Origin are served, so web pages can't reach it.
+type RPCServer struct {
+	// Clients sending it as "Authorization: Bearer <token>" can have transactions signed with the
+	// node key, which is never used when it is empty
+	Token string
+
+	node    *Node
+	methods map[string]rpcMethod
+
+	server   *http.Server
+	listener net.Listener
+	// Closed once the server stops serving
+	done chan bool
+}
+
+type rpcMethod func(r *http.Request, params json.RawMessage) (interface{}, error)
+
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+
+	return fmt.Sprintf("RPC error %d: %s", e.Code, e.Message)
+}
+
+type rpcRequest struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type RPCBlock struct {
+	Hash         string           `json:"hash"`
+	Height       int              `json:"height"`
+	Origin       string           `json:"origin"`
+	PrevBlock    string           `json:"prevBlock"`
+	MerkelRoot   string           `json:"merkelRoot"`
+	Timestamp    uint32           `json:"timestamp"`
+	Bits         uint32           `json:"bits"`
+	Nonce        uint32           `json:"nonce"`
+	Signature    string           `json:"signature"`
+	Transactions []RPCTransaction `json:"transactions"`
+}
+
+type RPCTransaction struct {
+	Hash          string `json:"hash"`
+	From          string `json:"from"`
+	To            string `json:"to"`
+	Amount        uint64 `json:"amount"`
+	Sequence      uint64 `json:"sequence"`
+	Fee           uint64 `json:"fee"`
+	Timestamp     uint32 `json:"timestamp"`
+	PayloadHash   string `json:"payloadHash"`
+	PayloadLength uint32 `json:"payloadLength"`
+	Nonce         uint32 `json:"nonce"`
+	Signature     string `json:"signature"`
+	Payload       []byte `json:"payload"`
+	// Block that includes the transaction, empty while it is in the mempool
+	Block string `json:"block,omitempty"`
+}
+
+func NewRPCServer(node *Node) *RPCServer {
+
+	s := &RPCServer{node: node}
+	s.methods = map[string]rpcMethod{
+		"submitTransaction": s.submitTransaction,
+		"getBlock":          s.getBlock,
+		"getTransaction":    s.getTransaction,
+		"getTip":            s.getTip,
+		"getPeers":          s.getPeers,
+		"getMempool":        s.getMempool,
+		"getMerkleProof":    s.getMerkleProof,
+		"getInbox":          s.getInbox,
+		"getOutbox":         s.getOutbox,
+		"getAccount":        s.getAccount,
+		"estimateFee":       s.estimateFee,
+
+		"getVerifiedTransactions": s.getVerifiedTransactions,
+	}
+
+	return s
+}
+
+// Starts serving in the background, use RPC_ADDRESS to only accept local connections
+func (s *RPCServer) Listen(address string) error {
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	s.listener = l
+	// Slow clients can't hold connections open
+	s.server = &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: RPC_READ_HEADER_TIMEOUT,
+		ReadTimeout:       RPC_READ_TIMEOUT,
+		WriteTimeout:      RPC_WRITE_TIMEOUT,
+		IdleTimeout:       RPC_IDLE_TIMEOUT,
+	}
+
+	fmt.Println("RPC listening in", l.Addr())
+	s.done = make(chan bool)
+	go func() {
+		defer close(s.done)
+		s.server.Serve(l)
+	}()
+
+	return nil
+}
+
+func (s *RPCServer) Address() string {
+
+	if s.listener == nil {
+		return ""
+	}
+
+	return s.listener.Addr().String()
+}
+
+// Closes the listener and the open connections, returns once the server goroutine is done
+func (s *RPCServer) Close() error {
+
+	if s.server == nil {
+		return nil
+	}
+
+	err := s.server.Close()
+	<-s.done
+
+	return err
+}
+
+func (s *RPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Pages open in a browser can post to local ports or rebind their domain to 127.0.0.1, but
+	// they can't send a JSON content type without a preflight nor hide their origin
+	if !isLoopbackHost(r.Host) || r.Header.Get("Origin") != "" {
+		http.Error(w, "Only local clients are served", http.StatusForbidden)
+		return
+	}
+	if t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || t != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	res := rpcResponse{Version: "2.0"}
+
+	req := rpcRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, RPC_MAX_REQUEST_SIZE)).Decode(&req); err != nil {
+		res.Error = &RPCError{RPC_PARSE_ERROR, err.Error()}
+		writeRPCResponse(w, res)
+		return
+	}
+	res.ID = req.ID
+
+	method := s.methods[req.Method]
+	switch {
+	case req.Version != "2.0":
+		res.Error = &RPCError{RPC_INVALID_REQUEST, "jsonrpc must be 2.0"}
+
+	case method == nil:
+		res.Error = &RPCError{RPC_METHOD_NOT_FOUND, "Unknown method " + req.Method}
+
+	default:
+		result, err := method(r, req.Params)
+		if err != nil {
+
+			rpcErr, ok := err.(*RPCError)
+			if !ok {
+				rpcErr = &RPCError{RPC_INTERNAL_ERROR, err.Error()}
+			}
+			res.Error = rpcErr
+		} else {
+			res.Result = result
+		}
+	}
+
+	writeRPCResponse(w, res)
+}
+
+func isLoopbackHost(host string) bool {
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *RPCServer) authorized(r *http.Request) bool {
+
+	if s.Token == "" {
+		return false
+	}
+	expected := "Bearer " + s.Token
+
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) == 1
+}
+
+func writeRPCResponse(w http.ResponseWriter, res rpcResponse) {
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func decodeRPCParams(params json.RawMessage, v interface{}) error {
+
+	if len(params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &RPCError{RPC_INVALID_PARAMS, err.Error()}
+	}
+
+	return nil
+}
+
+func decodeRPCHash(h string) ([]byte, error) {
+
+	hash, err := hex.DecodeString(h)
+	if err != nil || len(hash) != 32 {
+		return nil, &RPCError{RPC_INVALID_PARAMS, "Hashes are 32 bytes hex encoded"}
+	}
+
+	return hash, nil
+}
+
+// Either a raw hex encoded transaction signed by the client, or a payload to be signed with the
+// given keypair and sent to the optional recipient. Without a keypair it is signed with the node
+// key, which needs the RPC token.
+//
+// params: {"raw": "..."} or {"payload": "base64", "to": "base58", "amount": n, "fee": n, "public": "base58", "private": "base58"}
+func (s *RPCServer) submitTransaction(r *http.Request, params json.RawMessage) (interface{}, error) {
+
+	p := struct {
+		Raw     string `json:"raw"`
+		Payload []byte `json:"payload"`
+		To      string `json:"to"`
+		Amount  uint64 `json:"amount"`
+		Fee     uint64 `json:"fee"`
+		Public  string `json:"public"`
+		Private string `json:"private"`
+	}{}
+	if err := decodeRPCParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	var t *Transaction
+	switch {
+	case p.Raw != "":
+		d, err := hex.DecodeString(p.Raw)
+		if err != nil {
+			return nil, &RPCError{RPC_INVALID_PARAMS, err.Error()}
+		}
+
+		t = new(Transaction)
+		rest, err := t.UnmarshalBinary(d)
+		if err != nil || len(rest) > 0 {
+			return nil, &RPCError{RPC_INVALID_PARAMS, "Malformed transaction"}
+		}
+
+	case p.Payload != nil:
+		var keypair *Keypair
+		var err error
+		if p.Public != "" || p.Private != "" {
+
+			keypair = &Keypair{Public: []byte(p.Public), Private: []byte(p.Private)}
+			if _, err := base58.DecodeToBig(keypair.Public); err != nil {
+				return nil, &RPCError{RPC_INVALID_PARAMS, "Public key isn't base58"}
+			}
+			if _, err := base58.DecodeToBig(keypair.Private); err != nil {
+				return nil, &RPCError{RPC_INVALID_PARAMS, "Private key isn't base58"}
+			}
+		} else if !s.authorized(r) {
+			return nil, ErrRPCUnauthorized
+		} else if keypair, err = s.node.SigningKeypair(); err != nil {
+			return nil, err
+		}
+
+		var to []byte
+		if p.To != "" {
+			to = []byte(p.To)
+		}
+		if t, err = s.node.CreateTransferFrom(keypair, to, p.Amount, p.Fee, p.Payload); err != nil {
+			return nil, &RPCError{RPC_INVALID_PARAMS, err.Error()}
+		}
+
+	default:
+		return nil, &RPCError{RPC_INVALID_PARAMS, "Either raw or payload is required"}
+	}
+
+	if err := s.node.Blockchain.VerifyTransaction(t); err != nil {
+		return nil, &RPCError{RPC_INVALID_PARAMS, "Transaction verification fails: " + err.Error()}
+	}
+
+	// The queue is only read while the node runs
+	select {
+	case s.node.Blockchain.TransactionsQueue <- t:
+	case <-r.Context().Done():
+		return nil, errors.New("Transaction not queued, the node isn't running")
+	}
+
+	return map[string]string{"hash": hex.EncodeToString(t.Hash())}, nil
+}
+
+// params: {"hash": "..."} or {"height": n}, heights are in the main chain
+func (s *RPCServer) getBlock(r *http.Request, params json.RawMessage) (interface{}, error) {
+
+	p := struct {
+		Hash   string `json:"hash"`
+		Height *int   `json:"height"`
+	}{}
+	if err := decodeRPCParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	var b *Block
+	switch {
+	case p.Hash != "":
+		hash, err := decodeRPCHash(p.Hash)
+		if err != nil {
+			return nil, err
+		}
+		b = s.node.Blockchain.GetBlock(hash)
+
+	case p.Height != nil:
+		b = s.node.Blockchain.BlockAt(*p.Height)
+
+	default:
+		return nil, &RPCError{RPC_INVALID_PARAMS, "Either hash or height is required"}
+	}
+
+	if b == nil {
+		return nil, ErrRPCNotFound
+	}
+
+	return s.rpcBlock(b), nil
+}
+
+// params: {"hash": "..."}, looks in the mempool and the main chain
+func (s *RPCServer) getTransaction(r *http.Request, params json.RawMessage) (interface{}, error) {
+
+	p := struct {
+		Hash string `json:"hash"`
+	}{}
+	if err := decodeRPCParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	hash, err := decodeRPCHash(p.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if t := s.node.Blockchain.Mempool.Get(hash); t != nil {
+		return newRPCTransaction(t, nil), nil
+	}
+	if t, b := s.node.Blockchain.FindTransaction(hash); t != nil {
+		return newRPCTransaction(t, b), nil
+	}
+
+	return nil, ErrRPCNotFound
+}
+
+func (s *RPCServer) getTip(r *http.Request, params json.RawMessage) (interface{}, error) {
+
+	b := s.node.Blockchain.Tip()
+	if b == nil {
+		return nil, ErrRPCNotFound
+	}
+
+	return s.rpcBlock(b), nil
+}
+
+func (s *RPCServer) getPeers(r *http.Request, params json.RawMessage) (interface{}, error) {
+
+	return s.node.Network.PeerAddresses(), nil
+}
+
+func (s *RPCServer) getMempool(r *http.Request, params json.RawMessage) (interface{}, error) {
+
+	ts := s.node.Blockchain.Mempool.Transactions()
+
+	rts := make([]RPCTransaction, len(ts))
+	for i := range ts {
+		rts[i] = newRPCTransaction(&ts[i], nil)
+	}
+
+	return rts, nil
+}
+
+// params: {"transaction": "..."}, the transaction must be in the main chain.
+// Returns the binary proof hex encoded with the block it proves inclusion in.
+func (s *RPCServer) getMerkleProof(r *http.Request, params json.RawMessage) (interface{}, error) {
+
+	p := struct {
+		Transaction string `json:"transaction"`
+	}{}
+	if err := decodeRPCParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	hash, err := decodeRPCHash(p.Transaction)
+	if err != nil {
+		return nil, err
+	}
+
+	_, b := s.node.Blockchain.FindTransaction(hash)
+	if b == nil {
+		return nil, ErrRPCNotFound
+	}
+
+	for i, t := range *b.TransactionSlice {
+		if bytes.Equal(t.Hash(), hash) {
+
+			proof, err := b.MerkleProof(i)
+			if err != nil {
+				return nil, err
+			}
+			data, err := proof.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+
+			return map[string]string{
+				"proof":      hex.EncodeToString(data),
+				"block":      hex.EncodeToString(b.Hash()),
+				"merkelRoot": hex.EncodeToString(b.MerkelRoot),
+			}, nil
+		}
+	}
+
+	return nil, ErrRPCNotFound
+}
+
+// Transactions addressed to a light node, proven against its headers
+func (s *RPCServer) getVerifiedTransactions(r *http.Request, params json.RawMessage) (interface{}, error) {
+
+	if s.node.SPVClient == nil {
+		return nil, &RPCError{RPC_INVALID_REQUEST, "Only light nodes verify transactions with proofs"}
+	}
+
+	ts := s.node.SPVClient.VerifiedTransactions()
+
+	rts := make([]RPCTransaction, len(ts))
+	for i := range ts {
+		rts[i] = newRPCTransaction(&ts[i].Transaction, nil)
+		rts[i].Block = hex.EncodeToString(ts[i].Block)
+	}
+
+	return rts, nil
+}
+
+// Main chain transactions addressed to a key, the node key when there is none
+//
+// params: {"key": "base58"}
+func (s *RPCServer) getInbox(r *http.Request, params json.RawMessage) (interface{}, error) {
+
+	return s.keyHistory(params, s.node.Blockchain.Inbox)
+}
+
+// Main chain transactions sent by a key, the node key when there is none
+//
+// params: {"key": "base58"}
+func (s *RPCServer) getOutbox(r *http.Request, params json.RawMessage) (interface{}, error) {
+
+	return s.keyHistory(params, s.node.Blockchain.Outbox)
+}
+
+// Balance and sequence of a key in ledger chains, the node key when there is none
+//
+// params: {"key": "base58"}
+func (s *RPCServer) getAccount(r *http.Request, params json.RawMessage) (interface{}, error) {
+
+	if s.node.Blockchain.Ledger == nil {
+		return nil, &RPCError{RPC_INVALID_REQUEST, "The node doesn't keep a ledger"}
+	}
+
+	p := struct {
+		Key string `json:"key"`
+	}{}
+	if err := decodeRPCParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	key := s.node.Keypair.Public
+	if p.Key != "" {
+		key = []byte(p.Key)
+	}
+
+	a := s.node.Blockchain.Ledger.Account(key)
+
+	return map[string]uint64{"balance": a.Balance, "sequence": a.Sequence}, nil
+}
+
+// Fee per byte that got transactions into the last blocks, and the fee for a payload of that length
+//
+// params: {"blocks": n, "payloadLength": n}
+func (s *RPCServer) estimateFee(r *http.Request, params json.RawMessage) (interface{}, error) {
+
+	p := struct {
+		Blocks        int `json:"blocks"`
+		PayloadLength int `json:"payloadLength"`
+	}{Blocks: FEE_ESTIMATION_BLOCKS}
+	if err := decodeRPCParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Blocks <= 0 || p.PayloadLength < 0 {
+		return nil, &RPCError{RPC_INVALID_PARAMS, "Blocks must be positive and payload length not negative"}
+	}
+
+	rate := s.node.Blockchain.EstimateFeeRate(p.Blocks)
+
+	return map[string]interface{}{"feeRate": rate, "fee": FeeForPayload(rate, p.PayloadLength)}, nil
+}
+
+func (s *RPCServer) keyHistory(params json.RawMessage, history func([]byte) []IndexedTransaction) (interface{}, error) {
+
+	p := struct {
+		Key string `json:"key"`
+	}{}
+	if err := decodeRPCParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	key := s.node.Keypair.Public
+	if p.Key != "" {
+		key = []byte(p.Key)
+	}
+
+	ts := history(key)
+
+	rts := make([]RPCTransaction, len(ts))
+	for i := range ts {
+		rts[i] = newRPCTransaction(&ts[i].Transaction, nil)
+		rts[i].Block = hex.EncodeToString(ts[i].Block)
+	}
+
+	return rts, nil
+}
+
+func (s *RPCServer) rpcBlock(b *Block) RPCBlock {
+
+	hash := b.Hash()
+	rb := RPCBlock{
+		Hash:         hex.EncodeToString(hash),
+		Height:       s.node.Blockchain.BlockHeight(hash),
+		Origin:       string(b.Origin),
+		PrevBlock:    hex.EncodeToString(b.PrevBlock),
+		MerkelRoot:   hex.EncodeToString(b.MerkelRoot),
+		Timestamp:    b.Timestamp,
+		Bits:         b.Bits,
+		Nonce:        b.Nonce,
+		Signature:    string(b.Signature),
+		Transactions: make([]RPCTransaction, b.TransactionSlice.Len()),
+	}
+
+	for i := range *b.TransactionSlice {
+		rb.Transactions[i] = newRPCTransaction(&(*b.TransactionSlice)[i], b)
+	}
+
+	return rb
+}
+
+func newRPCTransaction(t *Transaction, b *Block) RPCTransaction {
+
+	rt := RPCTransaction{
+		Hash:          hex.EncodeToString(t.Hash()),
+		From:          string(t.Header.From),
+		To:            string(t.Header.To),
+		Amount:        t.Header.Amount,
+		Sequence:      t.Header.Sequence,
+		Fee:           t.Header.Fee,
+		Timestamp:     t.Header.Timestamp,
+		PayloadHash:   hex.EncodeToString(t.Header.PayloadHash),
+		PayloadLength: t.Header.PayloadLength,
+		Nonce:         t.Header.Nonce,
+		Signature:     string(t.Signature),
+		Payload:       t.Payload,
+	}
+	if b != nil {
+		rt.Block = hex.EncodeToString(b.Hash())
+	}
+
+	return rt
+}
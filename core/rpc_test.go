@@ -0,0 +1,263 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func rpcCall(t *testing.T, url, method string, params interface{}) (json.RawMessage, *RPCError) {
+
+	return rpcCallWithToken(t, url, "", method, params)
+}
+
+func rpcCallWithToken(t *testing.T, url, token, method string, params interface{}) (json.RawMessage, *RPCError) {
+
+	p, _ := json.Marshal(params)
+	body, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": json.RawMessage(p), "id": 1})
+
+	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	r := struct {
+		Result json.RawMessage `json:"result"`
+		Error  *RPCError       `json:"error"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+
+	return r.Result, r.Error
+}
+
+func TestRPCQueries(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	node := newTestNode(kp)
+
+	tr := newTestTransaction(kp, withTransfer(nil, 7, 1), withFee(3))
+	genesis := newTestBlock(kp, nil, tr)
+	b1 := newTestBlock(kp, &genesis, newTestTransaction(kp))
+	for _, b := range []Block{genesis, b1} {
+		if err := node.Blockchain.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := httptest.NewServer(NewRPCServer(node))
+	defer server.Close()
+
+	block := RPCBlock{}
+	res, rpcErr := rpcCall(t, server.URL, "getTip", nil)
+	if rpcErr != nil || json.Unmarshal(res, &block) != nil || block.Hash != hex.EncodeToString(b1.Hash()) || block.Height != 1 {
+		t.Error("Wrong tip", rpcErr, string(res))
+	}
+
+	res, rpcErr = rpcCall(t, server.URL, "getBlock", map[string]int{"height": 0})
+	if rpcErr != nil || json.Unmarshal(res, &block) != nil || block.Hash != hex.EncodeToString(genesis.Hash()) || len(block.Transactions) != 2 {
+		t.Error("Wrong block at height 0", rpcErr, string(res))
+	}
+
+	if _, rpcErr = rpcCall(t, server.URL, "getBlock", map[string]string{"hash": hex.EncodeToString(make([]byte, 32))}); rpcErr == nil || rpcErr.Code != RPC_NOT_FOUND {
+		t.Error("Unknown block found", rpcErr)
+	}
+
+	rt := RPCTransaction{}
+	res, rpcErr = rpcCall(t, server.URL, "getTransaction", map[string]string{"hash": hex.EncodeToString(tr.Hash())})
+	if rpcErr != nil || json.Unmarshal(res, &rt) != nil || rt.Block != hex.EncodeToString(genesis.Hash()) || !bytes.Equal(rt.Payload, tr.Payload) || rt.Amount != 7 || rt.Sequence != 1 || rt.Fee != 3 {
+		t.Error("Wrong transaction", rpcErr, string(res))
+	}
+
+	proof := struct {
+		Proof string `json:"proof"`
+	}{}
+	res, rpcErr = rpcCall(t, server.URL, "getMerkleProof", map[string]string{"transaction": hex.EncodeToString(tr.Hash())})
+	if rpcErr != nil || json.Unmarshal(res, &proof) != nil {
+		t.Fatal("No merkle proof", rpcErr)
+	}
+	data, _ := hex.DecodeString(proof.Proof)
+	mp := new(MerkleProof)
+	if mp.UnmarshalBinary(data) != nil || !VerifyMerkleProof(genesis.BlockHeader, mp) {
+		t.Error("Wrong merkle proof", proof.Proof)
+	}
+
+	history := []RPCTransaction{}
+	res, rpcErr = rpcCall(t, server.URL, "getOutbox", nil)
+	if rpcErr != nil || json.Unmarshal(res, &history) != nil || len(history) != 2 || history[0].Hash != hex.EncodeToString(tr.Hash()) {
+		t.Error("Wrong outbox", rpcErr, string(res))
+	}
+	res, rpcErr = rpcCall(t, server.URL, "getInbox", map[string]string{"key": string(kp.Public)})
+	if rpcErr != nil || json.Unmarshal(res, &history) != nil || len(history) != 2 || history[0].From != "" || history[0].Amount != genesis.Coinbase().Header.Amount {
+		t.Error("Wrong inbox, it should have the coinbases", rpcErr, string(res))
+	}
+
+	if _, rpcErr = rpcCall(t, server.URL, "mine", nil); rpcErr == nil || rpcErr.Code != RPC_METHOD_NOT_FOUND {
+		t.Error("Unknown method called", rpcErr)
+	}
+}
+
+func TestRPCSubmitTransaction(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	node := newTestNode(kp)
+
+	rpc := NewRPCServer(node)
+	rpc.Token = "secret"
+	server := httptest.NewServer(rpc)
+	defer server.Close()
+
+	received := make(chan *Transaction, 3)
+	go func() {
+		for i := 0; i < 3; i++ {
+			received <- <-node.Blockchain.TransactionsQueue
+		}
+	}()
+
+	tr, _ := node.CreateTransaction(nil, "hola")
+	raw, _ := tr.MarshalBinary()
+
+	res, rpcErr := rpcCall(t, server.URL, "submitTransaction", map[string]string{"raw": hex.EncodeToString(raw)})
+	if rpcErr != nil || !bytes.Equal((<-received).Hash(), tr.Hash()) {
+		t.Error("Raw transaction not submitted", rpcErr, string(res))
+	}
+
+	other := GenerateNewKeypair()
+	_, rpcErr = rpcCall(t, server.URL, "submitTransaction", map[string]interface{}{"payload": []byte("adios"), "public": string(other.Public), "private": string(other.Private)})
+	if sent := <-received; rpcErr != nil || !bytes.Equal(sent.Header.From, other.Public) || string(sent.Payload) != "adios" {
+		t.Error("Payload not signed with the given key", rpcErr)
+	}
+
+	// The node key needs the token
+	if _, rpcErr = rpcCall(t, server.URL, "submitTransaction", map[string]interface{}{"payload": []byte("para ti"), "to": string(other.Public)}); rpcErr == nil || rpcErr.Code != RPC_UNAUTHORIZED {
+		t.Error("Transaction signed with the node key without the token", rpcErr)
+	}
+	if _, rpcErr = rpcCallWithToken(t, server.URL, "wrong", "submitTransaction", map[string]interface{}{"payload": []byte("para ti")}); rpcErr == nil || rpcErr.Code != RPC_UNAUTHORIZED {
+		t.Error("Transaction signed with the node key with a wrong token", rpcErr)
+	}
+	_, rpcErr = rpcCallWithToken(t, server.URL, "secret", "submitTransaction", map[string]interface{}{"payload": []byte("para ti"), "to": string(other.Public)})
+	if sent := <-received; rpcErr != nil || !bytes.Equal(sent.Header.To, other.Public) {
+		t.Error("Transaction not addressed to the recipient", rpcErr)
+	}
+	if _, rpcErr = rpcCallWithToken(t, server.URL, "secret", "submitTransaction", map[string]interface{}{"payload": []byte("para nadie"), "to": "0"}); rpcErr == nil || rpcErr.Code != RPC_INVALID_PARAMS {
+		t.Error("Transaction to an invalid recipient submitted", rpcErr)
+	}
+
+	tr.Payload = []byte("changed")
+	raw, _ = tr.MarshalBinary()
+	if _, rpcErr = rpcCall(t, server.URL, "submitTransaction", map[string]string{"raw": hex.EncodeToString(raw)}); rpcErr == nil || rpcErr.Code != RPC_INVALID_PARAMS {
+		t.Error("Tampered transaction submitted", rpcErr)
+	}
+}
+
+func TestRPCRejectsBrowsers(t *testing.T) {
+
+	server := httptest.NewServer(NewRPCServer(newTestNode(GenerateNewKeypair())))
+	defer server.Close()
+
+	post := func(contentType string, header map[string]string) int {
+
+		body := `{"jsonrpc": "2.0", "method": "getPeers", "id": 1}`
+		req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		if host := header["Host"]; host != "" {
+			req.Host = host
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	if code := post("application/json", nil); code != http.StatusOK {
+		t.Error("Local JSON request rejected", code)
+	}
+	if code := post("text/plain", nil); code != http.StatusUnsupportedMediaType {
+		t.Error("Request without a JSON content type served", code)
+	}
+	if code := post("application/json", map[string]string{"Origin": "http://example.com"}); code != http.StatusForbidden {
+		t.Error("Request from a web page served", code)
+	}
+	if code := post("application/json", map[string]string{"Host": "rebound.example.com:9120"}); code != http.StatusForbidden {
+		t.Error("Request to a non loopback host served", code)
+	}
+}
+
+func TestRPCSubmitWithoutNode(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	node := newTestNode(kp)
+	tr, _ := node.CreateTransaction(nil, "hola")
+	raw, _ := tr.MarshalBinary()
+
+	s := NewRPCServer(node)
+	body, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "method": "submitTransaction", "params": map[string]string{"raw": hex.EncodeToString(raw)}, "id": 1})
+
+	// Nobody reads the queue of a node that isn't running, the request gives up with its context
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodPost, "http://127.0.0.1:9120", bytes.NewReader(body)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), "isn't running") {
+		t.Error("Submission to a stopped node", w.Body.String())
+	}
+}
+
+func TestRPCAccount(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	node := newTestLedgerNode(kp)
+	if err := node.Blockchain.AddBlock(newTestBlock(kp, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(NewRPCServer(node))
+	defer server.Close()
+
+	account := map[string]uint64{}
+	res, rpcErr := rpcCall(t, server.URL, "getAccount", nil)
+	if rpcErr != nil || json.Unmarshal(res, &account) != nil || account["balance"] != BLOCK_REWARD || account["sequence"] != 0 {
+		t.Error("Wrong account", rpcErr, string(res))
+	}
+}
+
+func TestRPCListen(t *testing.T) {
+
+	s := NewRPCServer(newTestNode(GenerateNewKeypair()))
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	url := "http://" + s.Address()
+	if _, rpcErr := rpcCall(t, url, "getPeers", nil); rpcErr != nil {
+		t.Error("Listening server doesn't answer", rpcErr)
+	}
+
+	s.Close()
+	if _, err := http.Post(url, "application/json", nil); err == nil {
+		t.Error("Server still answers after Close")
+	}
+}
@@ -0,0 +1,339 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/izqui/helpers"
+)
+
+// Light client side of a node running with NodeOptions.Light: the chain only has headers and the
+// transactions addressed to the watched keys are fetched from full peers with a merkel proof,
+// which is checked against a header of our chain.
+type SPVClient struct {
+	node *Node
+
+	keys         [][]byte
+	transactions map[string]*VerifiedTransaction
+
+	lock sync.Mutex
+}
+
+// Transaction proven to be in a block of our header chain
+type VerifiedTransaction struct {
+	Transaction
+	Block []byte
+	Proof *MerkleProof
+}
+
+func NewSPVClient(node *Node) *SPVClient {
+
+	return &SPVClient{node: node, keys: [][]byte{node.Keypair.Public}, transactions: map[string]*VerifiedTransaction{}}
+}
+
+// Starts watching transactions addressed to key, only blocks received afterwards are checked
+func (c *SPVClient) WatchKey(key []byte) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, k := range c.keys {
+		if bytes.Equal(k, key) {
+			return
+		}
+	}
+	c.keys = append(c.keys, key)
+}
+
+func (c *SPVClient) WatchedKeys() [][]byte {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append([][]byte{}, c.keys...)
+}
+
+// Verified transactions sorted by timestamp
+func (c *SPVClient) VerifiedTransactions() []VerifiedTransaction {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ts := make([]VerifiedTransaction, 0, len(c.transactions))
+	for _, t := range c.transactions {
+		ts = append(ts, *t)
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].Header.Timestamp < ts[j].Header.Timestamp })
+
+	return ts
+}
+
+// Asks a full peer for the transactions addressed to our keys in the given blocks
+func (c *SPVClient) RequestProofs(peer string, blocks [][]byte) {
+
+	for len(blocks) > 0 {
+
+		n := len(blocks)
+		if n > MAX_HEADERS_PER_MESSAGE {
+			n = MAX_HEADERS_PER_MESSAGE
+		}
+
+		for _, k := range c.WatchedKeys() {
+
+			m := NewMessage(MESSAGE_GET_MERKLE_PROOFS)
+			m.Data = MarshalProofsRequest(k, blocks[:n])
+
+			if err := c.node.Network.SendTo(peer, *m); err != nil {
+				networkError(err)
+				return
+			}
+		}
+		blocks = blocks[n:]
+	}
+}
+
+// Takes the watched transactions of a full block we received, it must have been verified already.
+// Nothing is taken unless the block is in our main chain.
+func (c *SPVClient) ScanBlock(b Block) {
+
+	ts := []VerifiedTransaction{}
+	for i, t := range *b.TransactionSlice {
+
+		if !c.watching(t.Header.To) {
+			continue
+		}
+
+		proof, err := b.MerkleProof(i)
+		if err != nil {
+			continue
+		}
+		ts = append(ts, VerifiedTransaction{t, b.Hash(), proof})
+	}
+
+	if len(ts) > 0 && !c.addConnected(b.Hash(), ts) {
+		fmt.Println("Not taking transactions of block", b.Hash(), "outside the main chain")
+	}
+}
+
+// Checks the transactions sent by a full peer against the header we have for their block, which
+// must be in our main chain: side branch headers are cheap to make.
+func (c *SPVClient) HandleProofs(peer string, block []byte, ts []VerifiedTransaction) {
+
+	b := c.node.Blockchain.GetBlock(block)
+	if b == nil {
+		fmt.Println("Received proofs for an unknown block from", peer)
+		return
+	}
+
+	proven := []VerifiedTransaction{}
+	for _, t := range ts {
+
+		// The coinbase isn't signed, its proof must put it first in the block
+		valid := c.watching(t.Header.To) &&
+			bytes.Equal(t.Proof.Hash, t.Hash()) &&
+			VerifyMerkleProof(b.BlockHeader, t.Proof) &&
+			(t.IsCoinbase() && t.Proof.Index == 0 || t.VerifyTransaction(c.node.options.TransactionPow, c.node.options.Consensus) == nil)
+
+		if !valid {
+			fmt.Println("Received invalid merkle proof from", peer)
+			continue
+		}
+
+		t.Block = block
+		proven = append(proven, t)
+	}
+
+	if len(proven) > 0 && !c.addConnected(block, proven) {
+		fmt.Println("Received proofs for a block outside the main chain from", peer)
+	}
+}
+
+// Forgets the transactions of a block rolled back by a reorganization
+func (c *SPVClient) Disconnect(block []byte) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for h, t := range c.transactions {
+		if bytes.Equal(t.Block, block) {
+			delete(c.transactions, h)
+		}
+	}
+}
+
+// Adds the transactions if their block is in the main chain. The chain lock is held meanwhile so
+// a reorganization can't disconnect the block in between.
+func (c *SPVClient) addConnected(block []byte, ts []VerifiedTransaction) bool {
+
+	bl := c.node.Blockchain
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	if !bl.inMainChain(block) {
+		return false
+	}
+	for _, t := range ts {
+		c.add(t)
+	}
+
+	return true
+}
+
+func (c *SPVClient) watching(key []byte) bool {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, k := range c.keys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *SPVClient) add(t VerifiedTransaction) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.transactions[string(t.Hash())] = &t
+}
+
+// Transactions of the given blocks addressed to key, with their proofs. Used by full nodes to answer light clients.
+func (bl *Blockchain) ProofsFor(key []byte, blocks [][]byte) map[string][]VerifiedTransaction {
+
+	proofs := map[string][]VerifiedTransaction{}
+	for _, h := range blocks {
+
+		b := bl.GetBlock(h)
+		if b == nil {
+			continue
+		}
+
+		for i, t := range *b.TransactionSlice {
+
+			if !bytes.Equal(t.Header.To, key) {
+				continue
+			}
+			if proof, err := b.MerkleProof(i); err == nil {
+				proofs[string(h)] = append(proofs[string(h)], VerifiedTransaction{t, h, proof})
+			}
+		}
+	}
+
+	return proofs
+}
+
+// Proof requests are encoded as the watched key (80 bytes) followed by a hash list of blocks
+func MarshalProofsRequest(key []byte, blocks [][]byte) []byte {
+
+	return append(helpers.FitBytesInto(key, NETWORK_KEY_SIZE), MarshalHashes(blocks)...)
+}
+
+func UnmarshalProofsRequest(d []byte) ([]byte, [][]byte, error) {
+
+	if len(d) < NETWORK_KEY_SIZE {
+		return nil, nil, ErrEncodingTruncated
+	}
+
+	blocks, err := UnmarshalHashes(d[NETWORK_KEY_SIZE:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return helpers.StripByte(d[:NETWORK_KEY_SIZE], 0), blocks, nil
+}
+
+// Proofs for one block are encoded as:
+//
+//	block hash (32 bytes) | count (4 bytes) | (transaction length (4 bytes) | transaction | proof length (4 bytes) | proof)*
+func MarshalProofs(block []byte, ts []VerifiedTransaction) ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+	buf.Write(helpers.FitBytesInto(block, 32))
+	binary.Write(buf, binary.LittleEndian, uint32(len(ts)))
+
+	for _, t := range ts {
+
+		tb, err := t.Transaction.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		pb, err := t.Proof.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+
+		binary.Write(buf, binary.LittleEndian, uint32(len(tb)))
+		buf.Write(tb)
+		binary.Write(buf, binary.LittleEndian, uint32(len(pb)))
+		buf.Write(pb)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func UnmarshalProofs(d []byte) ([]byte, []VerifiedTransaction, error) {
+
+	if len(d) < 32+4 {
+		return nil, nil, ErrEncodingTruncated
+	}
+
+	buf := bytes.NewBuffer(d)
+	block := buf.Next(32)
+
+	var count uint32
+	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &count)
+
+	next := func() ([]byte, error) {
+
+		if buf.Len() < 4 {
+			return nil, ErrEncodingTruncated
+		}
+		var l uint32
+		binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &l)
+		if uint64(l) > uint64(buf.Len()) {
+			return nil, ErrEncodingOverrun
+		}
+
+		return buf.Next(int(l)), nil
+	}
+
+	ts := []VerifiedTransaction{}
+	for i := uint32(0); i < count; i++ {
+
+		tb, err := next()
+		if err != nil {
+			return nil, nil, err
+		}
+		pb, err := next()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		t := VerifiedTransaction{Block: block, Proof: new(MerkleProof)}
+		rest, err := t.Transaction.UnmarshalBinary(tb)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rest) > 0 {
+			return nil, nil, ErrEncodingOverrun
+		}
+		if err := t.Proof.UnmarshalBinary(pb); err != nil {
+			return nil, nil, err
+		}
+
+		ts = append(ts, t)
+	}
+
+	if buf.Len() > 0 {
+		return nil, nil, ErrEncodingOverrun
+	}
+
+	return block, ts, nil
+}
@@ -0,0 +1,157 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/izqui/helpers"
+)
+
+func TestLightNodeVerifiesProofs(t *testing.T) {
+
+	kp, lightKp := GenerateNewKeypair(), GenerateNewKeypair()
+	full := newTestNode(kp)
+	light, err := NewNode(NodeOptions{Keypair: lightKp, Light: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := NewTransaction(kp.Public, lightKp.Public, []byte("for the light node"))
+	tr.Header.Nonce = tr.GenerateNonce(TRANSACTION_POW)
+	tr.Signature = tr.Sign(kp)
+
+	// Light nodes check the proof of work of the headers
+	genesis := newTestBlock(kp, nil, newTestTransaction(kp), tr, newTestTransaction(kp))
+	genesis.Nonce = genesis.GenerateNonce()
+	genesis.Signature = genesis.Sign(kp)
+	if err := full.Blockchain.AddBlock(genesis); err != nil {
+		t.Fatal(err)
+	}
+
+	light.Syncer.HandleHeaders("full", full.Blockchain.HeadersAfter(nil, MAX_HEADERS_PER_MESSAGE))
+	if !light.Blockchain.HasBlock(genesis.Hash()) || light.Blockchain.Tip().TransactionSlice.Len() != 0 {
+		t.Fatal("Light node should have the header only")
+	}
+
+	proofs := full.Blockchain.ProofsFor(lightKp.Public, [][]byte{genesis.Hash()})[string(genesis.Hash())]
+	if len(proofs) != 1 {
+		t.Fatal("Expected one transaction for the light node, got", len(proofs))
+	}
+
+	data, err := MarshalProofs(genesis.Hash(), proofs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, ts, err := UnmarshalProofs(data)
+	if err != nil || !bytes.Equal(block, genesis.Hash()) || len(ts) != 1 {
+		t.Fatal("Marshall, unmarshall proofs failed", err)
+	}
+
+	// A peer can't change the transaction it proves
+	tampered := ts[0]
+	tampered.Payload = []byte("for the light node!")
+	tampered.Header.PayloadHash = nil
+	light.SPVClient.HandleProofs("full", block, []VerifiedTransaction{tampered})
+	if len(light.SPVClient.VerifiedTransactions()) != 0 {
+		t.Error("Tampered transaction verified")
+	}
+
+	light.SPVClient.HandleProofs("full", block, ts)
+	verified := light.SPVClient.VerifiedTransactions()
+	if len(verified) != 1 || !bytes.Equal(verified[0].Hash(), tr.Hash()) {
+		t.Error("Transaction not verified")
+	}
+}
+
+func TestLightNodeOnlyTrustsMainChain(t *testing.T) {
+
+	kp, lightKp := GenerateNewKeypair(), GenerateNewKeypair()
+	light, err := NewNode(NodeOptions{Keypair: lightKp, Light: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := light.Blockchain
+
+	transfer := func() *Transaction {
+		tr := NewTransaction(kp.Public, lightKp.Public, []byte(helpers.RandomString(16)))
+		tr.Header.Nonce = tr.GenerateNonce(TRANSACTION_POW)
+		tr.Signature = tr.Sign(kp)
+		return tr
+	}
+	mine := func(parent *Block, trs ...*Transaction) Block {
+		b := newTestBlock(kp, parent, trs...)
+		b.Nonce = b.GenerateNonce()
+		b.Signature = b.Sign(kp)
+		return b
+	}
+	header := func(b Block) Block {
+		return Block{b.BlockHeader, b.Signature, new(TransactionSlice)}
+	}
+	proof := func(b Block, i int) VerifiedTransaction {
+		p, err := b.MerkleProof(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return VerifiedTransaction{(*b.TransactionSlice)[i], b.Hash(), p}
+	}
+
+	genesis := mine(nil)
+	a1 := mine(&genesis, transfer())
+	b1 := mine(&genesis, transfer())
+	for _, b := range []Block{genesis, a1, b1} {
+		if _, err := bl.ProcessBlock(header(b), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A block that doesn't connect to our chain proves nothing
+	orphan := newTestBlock(kp, &a1, transfer())
+	orphan.PrevBlock = []byte(helpers.RandomString(32))
+	orphan.Nonce = orphan.GenerateNonce()
+	if _, err := bl.ProcessBlock(header(orphan), ""); err != ErrOrphanBlock {
+		t.Fatal("Expected an orphan", err)
+	}
+	light.SPVClient.ScanBlock(orphan)
+	if len(light.SPVClient.VerifiedTransactions()) != 0 {
+		t.Error("Transaction of an orphan block verified")
+	}
+
+	// Neither does a side branch
+	light.SPVClient.ScanBlock(b1)
+	light.SPVClient.HandleProofs("full", b1.Hash(), []VerifiedTransaction{proof(b1, 1)})
+	if len(light.SPVClient.VerifiedTransactions()) != 0 {
+		t.Error("Transaction of a side branch verified")
+	}
+
+	light.SPVClient.ScanBlock(a1)
+	verified := light.SPVClient.VerifiedTransactions()
+	if len(verified) != 1 || !bytes.Equal(verified[0].Block, a1.Hash()) {
+		t.Fatal("Transaction of the main chain not verified")
+	}
+
+	// Once the other branch takes over, a1 transactions are gone and b1 ones can be proven
+	if _, err := bl.ProcessBlock(header(mine(&b1)), ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(light.SPVClient.VerifiedTransactions()) != 0 {
+		t.Error("Transaction of a disconnected block still verified")
+	}
+
+	light.SPVClient.HandleProofs("full", b1.Hash(), []VerifiedTransaction{proof(b1, 1)})
+	verified = light.SPVClient.VerifiedTransactions()
+	if len(verified) != 1 || !bytes.Equal(verified[0].Block, b1.Hash()) {
+		t.Error("Transaction of the new main chain not verified")
+	}
+}
+
+func TestProofsRequestMarshalling(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	b := newTestBlock(kp, nil)
+	hashes := [][]byte{b.Hash()}
+
+	key, blocks, err := UnmarshalProofsRequest(MarshalProofsRequest(kp.Public, hashes))
+	if err != nil || !bytes.Equal(key, kp.Public) || len(blocks) != 1 || !bytes.Equal(blocks[0], hashes[0]) {
+		t.Error("Marshall, unmarshall proofs request failed", err)
+	}
+}
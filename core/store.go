@@ -0,0 +1,368 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Append only block storage.
+// Blocks are written as records into numbered segment files:
+//
+//	length (4 bytes) | crc32 of data (4 bytes) | Block.MarshalBinary (length bytes)
+//
+// The index by Block.Hash() is rebuilt in memory every time the store is opened.
+type BlockStore struct {
+	directory string
+
+	index  map[string]blockLocation
+	hashes [][]byte
+
+	segment       *os.File
+	segmentNumber int
+	segmentSize   int64
+
+	lock sync.Mutex
+}
+
+type blockLocation struct {
+	segment int
+	offset  int64
+	length  uint32
+}
+
+var (
+	ErrBlockNotFound     = errors.New("Block not found in store")
+	ErrCorruptBlockStore = errors.New("Block store is corrupt")
+)
+
+func OpenBlockStore(directory string) (*BlockStore, error) {
+
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &BlockStore{directory: directory, index: map[string]blockLocation{}}
+
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, n := range segments {
+
+		last := i == len(segments)-1
+		if err := s.replaySegment(n, last); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(segments) > 0 {
+		s.segmentNumber = segments[len(segments)-1]
+	}
+
+	if err := s.openSegment(s.segmentNumber); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *BlockStore) Append(b Block) error {
+
+	data, err := b.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	hash := b.Hash()
+	if _, ok := s.index[string(hash)]; ok {
+		return nil
+	}
+
+	if s.segmentSize > 0 && s.segmentSize+BLOCK_STORE_RECORD_HEADER_SIZE+int64(len(data)) > BLOCK_STORE_SEGMENT_SIZE {
+
+		if err := s.openSegment(s.segmentNumber + 1); err != nil {
+			return err
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+	binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(data))
+	buf.Write(data)
+
+	if _, err := s.segment.Write(buf.Bytes()); err != nil {
+		s.discardWrite()
+		return err
+	}
+	if err := s.segment.Sync(); err != nil {
+		s.discardWrite()
+		return err
+	}
+
+	s.addToIndex(hash, blockLocation{s.segmentNumber, s.segmentSize + BLOCK_STORE_RECORD_HEADER_SIZE, uint32(len(data))})
+	s.segmentSize += int64(buf.Len())
+
+	return nil
+}
+
+// Drops whatever part of a failed record made it to the segment, so the next one is written where
+// segmentSize says. When that fails too, segmentSize follows the file instead.
+func (s *BlockStore) discardWrite() {
+
+	if err := s.segment.Truncate(s.segmentSize); err == nil {
+		return
+	}
+
+	if info, err := s.segment.Stat(); err == nil {
+		s.segmentSize = info.Size()
+	}
+}
+
+func (s *BlockStore) Has(hash []byte) bool {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, ok := s.index[string(hash)]
+	return ok
+}
+
+func (s *BlockStore) Get(hash []byte) (*Block, error) {
+
+	s.lock.Lock()
+	loc, ok := s.index[string(hash)]
+	s.lock.Unlock()
+
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+
+	return s.read(loc)
+}
+
+// Returns every stored block in the order they were appended
+func (s *BlockStore) Blocks() (BlockSlice, error) {
+
+	s.lock.Lock()
+	hashes := s.hashes
+	s.lock.Unlock()
+
+	bs := make(BlockSlice, 0, len(hashes))
+	for _, h := range hashes {
+
+		b, err := s.Get(h)
+		if err != nil {
+			return nil, err
+		}
+		bs = append(bs, *b)
+	}
+
+	return bs, nil
+}
+
+func (s *BlockStore) Len() int {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.hashes)
+}
+
+// Flushes the current segment to disk
+func (s *BlockStore) Sync() error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.segment == nil {
+		return nil
+	}
+
+	return s.segment.Sync()
+}
+
+func (s *BlockStore) Close() error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.segment == nil {
+		return nil
+	}
+
+	err := s.segment.Close()
+	s.segment = nil
+
+	return err
+}
+
+func (s *BlockStore) read(loc blockLocation) (*Block, error) {
+
+	f, err := os.Open(s.segmentPath(loc.segment))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := make([]byte, loc.length)
+	if _, err := f.ReadAt(data, loc.offset); err != nil {
+		return nil, err
+	}
+
+	b := new(Block)
+	if err := b.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Reads every record of a segment into the index. A torn record at the end of the last segment
+// (the node crashed in the middle of a write) is truncated away, anywhere else it means the store is corrupt.
+func (s *BlockStore) replaySegment(n int, last bool) error {
+
+	f, err := os.OpenFile(s.segmentPath(n), os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	header := make([]byte, BLOCK_STORE_RECORD_HEADER_SIZE)
+
+	for {
+
+		if _, err := io.ReadFull(f, header); err != nil {
+
+			if err == io.EOF {
+				return nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return s.recoverSegment(f, n, offset, last)
+			}
+			return err
+		}
+
+		var length, checksum uint32
+		binary.Read(bytes.NewBuffer(header[:4]), binary.LittleEndian, &length)
+		binary.Read(bytes.NewBuffer(header[4:]), binary.LittleEndian, &checksum)
+
+		// A length past the end of the file is a torn or corrupt header, don't trust it for the allocation
+		if int64(length) > info.Size()-offset-BLOCK_STORE_RECORD_HEADER_SIZE {
+			return s.recoverSegment(f, n, offset, last)
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(f, data); err != nil {
+
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return s.recoverSegment(f, n, offset, last)
+			}
+			return err
+		}
+
+		if crc32.ChecksumIEEE(data) != checksum {
+			return s.recoverSegment(f, n, offset, last)
+		}
+
+		b := new(Block)
+		// The record was written whole, a block we can't decode comes from an older encoding
+		// and truncating it would lose data
+		if err := b.UnmarshalBinary(data); err != nil {
+			return fmt.Errorf("%v: undecodable block in segment %d at offset %d: %v", ErrCorruptBlockStore, n, offset, err)
+		}
+
+		s.addToIndex(b.Hash(), blockLocation{n, offset + BLOCK_STORE_RECORD_HEADER_SIZE, length})
+		offset += BLOCK_STORE_RECORD_HEADER_SIZE + int64(length)
+	}
+}
+
+func (s *BlockStore) recoverSegment(f *os.File, n int, offset int64, last bool) error {
+
+	if !last {
+		return fmt.Errorf("%v: bad record in segment %d at offset %d", ErrCorruptBlockStore, n, offset)
+	}
+
+	fmt.Println("Truncating torn block record in segment", n, "at offset", offset)
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+func (s *BlockStore) addToIndex(hash []byte, loc blockLocation) {
+
+	if _, ok := s.index[string(hash)]; ok {
+		return
+	}
+
+	s.index[string(hash)] = loc
+	s.hashes = append(s.hashes, hash)
+}
+
+func (s *BlockStore) openSegment(n int) error {
+
+	if s.segment != nil {
+		if err := s.segment.Close(); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(s.segmentPath(n), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.segment, s.segmentNumber, s.segmentSize = f, n, info.Size()
+
+	return nil
+}
+
+func (s *BlockStore) segments() ([]int, error) {
+
+	names, err := filepath.Glob(filepath.Join(s.directory, "*"+BLOCK_STORE_SEGMENT_EXTENSION))
+	if err != nil {
+		return nil, err
+	}
+
+	ns := []int{}
+	for _, name := range names {
+
+		var n int
+		if _, err := fmt.Sscanf(filepath.Base(name), "%d"+BLOCK_STORE_SEGMENT_EXTENSION, &n); err == nil {
+			ns = append(ns, n)
+		}
+	}
+	sort.Ints(ns)
+
+	return ns, nil
+}
+
+func (s *BlockStore) segmentPath(n int) string {
+
+	return filepath.Join(s.directory, fmt.Sprintf("%06d%s", n, BLOCK_STORE_SEGMENT_EXTENSION))
+}
@@ -0,0 +1,179 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/izqui/helpers"
+)
+
+func newTestStoreBlock(kp *Keypair, prev []byte) Block {
+
+	b := NewBlock(prev)
+	b.BlockHeader.Origin = kp.Public
+
+	tr := NewTransaction(kp.Public, nil, []byte(helpers.RandomString(helpers.RandomInt(1, 1024))))
+	tr.Signature = tr.Sign(kp)
+	b.AddTransaction(tr)
+
+	b.BlockHeader.MerkelRoot = b.GenerateMerkelRoot()
+	b.Signature = b.Sign(kp)
+
+	return b
+}
+
+func TestBlockStoreReopen(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "blockstore")
+	defer os.RemoveAll(dir)
+
+	s, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kp := GenerateNewKeypair()
+	blocks := BlockSlice{}
+	prev := []byte{}
+	for i := 0; i < 3; i++ {
+		b := newTestStoreBlock(kp, prev)
+		if err := s.Append(b); err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, b)
+		prev = b.Hash()
+	}
+	s.Close()
+
+	s, err = OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	stored, err := s.Blocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != len(blocks) {
+		t.Fatal("Expected", len(blocks), "blocks, got", len(stored))
+	}
+
+	for i := range blocks {
+		if !reflect.DeepEqual(stored[i].Hash(), blocks[i].Hash()) {
+			t.Error("Block", i, "differs after reopening the store")
+		}
+	}
+
+	b, err := s.Get(blocks[1].Hash())
+	if err != nil || !reflect.DeepEqual(b.Hash(), blocks[1].Hash()) {
+		t.Error("Get by hash failed", err)
+	}
+}
+
+func TestBlockStoreTornRecord(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "blockstore")
+	defer os.RemoveAll(dir)
+
+	s, _ := OpenBlockStore(dir)
+	kp := GenerateNewKeypair()
+	b1 := newTestStoreBlock(kp, nil)
+	s.Append(b1)
+	s.Close()
+
+	// Simulate a crash in the middle of writing a record
+	segment := filepath.Join(dir, "000000"+BLOCK_STORE_SEGMENT_EXTENSION)
+	f, _ := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{200, 0, 0, 0, 1, 2, 3, 4, 5, 6})
+	f.Close()
+
+	s, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Len() != 1 {
+		t.Error("Expected torn record to be dropped, got", s.Len(), "blocks")
+	}
+
+	b2 := newTestStoreBlock(kp, b1.Hash())
+	if err := s.Append(b2); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, _ = OpenBlockStore(dir)
+	defer s.Close()
+
+	if s.Len() != 2 || !s.Has(b2.Hash()) {
+		t.Error("Block appended after recovery was lost")
+	}
+}
+
+func TestBlockStoreFailedAppend(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "blockstore")
+	defer os.RemoveAll(dir)
+
+	s, _ := OpenBlockStore(dir)
+	kp := GenerateNewKeypair()
+	b1 := newTestStoreBlock(kp, nil)
+	s.Append(b1)
+
+	// Part of a record written before the write failed
+	segment := filepath.Join(dir, "000000"+BLOCK_STORE_SEGMENT_EXTENSION)
+	f, _ := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{200, 0, 0, 0, 1, 2, 3, 4, 5, 6})
+	f.Close()
+	s.discardWrite()
+
+	b2 := newTestStoreBlock(kp, b1.Hash())
+	if err := s.Append(b2); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := s.Get(b2.Hash()); err != nil || !reflect.DeepEqual(b.Hash(), b2.Hash()) {
+		t.Error("Block appended after a failed write read from the wrong offset", err)
+	}
+	s.Close()
+
+	s, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.Len() != 2 || !s.Has(b2.Hash()) {
+		t.Error("Block appended after a failed write was lost")
+	}
+}
+
+func TestBlockStoreOversizedRecord(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "blockstore")
+	defer os.RemoveAll(dir)
+
+	s, _ := OpenBlockStore(dir)
+	s.Append(newTestStoreBlock(GenerateNewKeypair(), nil))
+	s.Close()
+
+	// A corrupt length must not be allocated before it's checked
+	segment := filepath.Join(dir, "000000"+BLOCK_STORE_SEGMENT_EXTENSION)
+	f, _ := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4, 5, 6})
+	f.Close()
+
+	s, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.Len() != 1 {
+		t.Error("Expected oversized record to be dropped, got", s.Len(), "blocks")
+	}
+}
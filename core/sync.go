@@ -0,0 +1,444 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/izqui/helpers"
+)
+
+// Downloads the blocks we are missing from the network.
+//
+// Peers are asked for the headers that follow our chain (MESSAGE_GET_HEADERS with a block locator).
+// Headers we don't have are then requested in batches (MESSAGE_GET_BLOCK) spread among every peer
+// that announced them, and the blocks arriving out of order wait in the orphan pool.
+type Syncer struct {
+	node *Node
+
+	inFlight  map[string]syncRequest
+	announced map[string][]string
+	next      int
+
+	lastMissingRequest time.Time
+
+	lock sync.Mutex
+}
+
+type syncRequest struct {
+	peer string
+	time time.Time
+}
+
+func NewSyncer(node *Node) *Syncer {
+
+	return &Syncer{node: node, inFlight: map[string]syncRequest{}, announced: map[string][]string{}}
+}
+
+func (s *Syncer) Run(ctx context.Context) {
+
+	for {
+		select {
+		case <-time.After(SYNC_INTERVAL):
+			s.expireRequests()
+			s.RequestHeaders()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Asks every peer for the headers after our best chain
+func (s *Syncer) RequestHeaders() {
+
+	s.node.Network.BroadcastQueue <- *newGetHeadersMessage(s.node.Blockchain.Locator())
+}
+
+func (s *Syncer) RequestHeadersFrom(peer string) {
+
+	if err := s.node.Network.SendTo(peer, *newGetHeadersMessage(s.node.Blockchain.Locator())); err != nil {
+		networkError(err)
+	}
+}
+
+// Called when a block arrives without its parent. Rate limited so a burst of orphans doesn't flood peers.
+func (s *Syncer) RequestMissing() {
+
+	s.lock.Lock()
+	if time.Since(s.lastMissingRequest) < SYNC_MISSING_REQUEST_INTERVAL {
+		s.lock.Unlock()
+		return
+	}
+	s.lastMissingRequest = time.Now()
+	s.lock.Unlock()
+
+	s.RequestHeaders()
+}
+
+func (s *Syncer) HandleHeaders(peer string, headers BlockSlice) {
+
+	if s.node.options.Light {
+		s.connectHeaders(peer, headers)
+	} else {
+		s.requestBlocks(s.neededBlocks(peer, headers))
+	}
+
+	// The peer has more headers than fit in one message, keep going from the last one
+	if len(headers) == MAX_HEADERS_PER_MESSAGE {
+
+		locator := append([][]byte{headers[len(headers)-1].Hash()}, s.node.Blockchain.Locator()...)
+		if err := s.node.Network.SendTo(peer, *newGetHeadersMessage(locator)); err != nil {
+			networkError(err)
+		}
+	}
+}
+
+// Hashes of the announced blocks we don't have and aren't downloading yet
+func (s *Syncer) neededBlocks(peer string, headers BlockSlice) [][]byte {
+
+	needed := [][]byte{}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, h := range headers {
+
+		if err := h.VerifyHeader(s.node.options.Consensus.PowLimitBits); err != nil {
+			fmt.Println("Received invalid header from", peer, err)
+			break
+		}
+
+		hash := h.Hash()
+		key := string(hash)
+		s.announced[key] = append(s.announced[key], peer)
+
+		if _, ok := s.inFlight[key]; ok || s.node.Blockchain.HasBlock(hash) {
+			continue
+		}
+		needed = append(needed, hash)
+	}
+
+	return needed
+}
+
+// Light nodes add the headers straight to their chain, which checks they link to it and follow
+// the difficulty rule, and then ask the peer for the transactions addressed to them.
+func (s *Syncer) connectHeaders(peer string, headers BlockSlice) {
+
+	added := [][]byte{}
+	for _, h := range headers {
+
+		if err := h.VerifyHeader(s.node.options.Consensus.PowLimitBits); err != nil {
+			fmt.Println("Received invalid header from", peer, err)
+			break
+		}
+
+		hash := h.Hash()
+		if s.node.Blockchain.HasBlock(hash) {
+			continue
+		}
+		if _, err := s.node.Blockchain.ProcessBlock(h, peer); err != nil {
+			fmt.Println("Header from", peer, "not added:", err)
+			break
+		}
+		added = append(added, hash)
+	}
+
+	if len(added) > 0 {
+		s.node.SPVClient.RequestProofs(peer, added)
+	}
+}
+
+func (s *Syncer) BlockReceived(hash []byte) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.inFlight, string(hash))
+	delete(s.announced, string(hash))
+}
+
+// Splits the hashes in batches and sends each batch to a different peer among the ones that announced it
+func (s *Syncer) requestBlocks(hashes [][]byte) {
+
+	for len(hashes) > 0 {
+
+		n := len(hashes)
+		if n > MAX_BLOCKS_PER_REQUEST {
+			n = MAX_BLOCKS_PER_REQUEST
+		}
+		batch := hashes[:n]
+		hashes = hashes[n:]
+
+		s.lock.Lock()
+		// Peers that announced the last header of the batch have the ones before it too
+		peers := s.announced[string(batch[len(batch)-1])]
+		if len(peers) == 0 {
+			s.lock.Unlock()
+			continue
+		}
+		peer := peers[s.next%len(peers)]
+		s.next++
+
+		for _, h := range batch {
+			s.inFlight[string(h)] = syncRequest{peer, time.Now()}
+		}
+		s.lock.Unlock()
+
+		m := NewMessage(MESSAGE_GET_BLOCK)
+		m.Data = MarshalHashes(batch)
+
+		if err := s.node.Network.SendTo(peer, *m); err != nil {
+			networkError(err)
+			s.forget(batch)
+		}
+	}
+}
+
+func (s *Syncer) forget(hashes [][]byte) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, h := range hashes {
+		delete(s.inFlight, string(h))
+	}
+}
+
+// Requests that didn't get an answer are dropped so the next round of headers asks someone else
+func (s *Syncer) expireRequests() {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for k, r := range s.inFlight {
+		if time.Since(r.time) > SYNC_REQUEST_TIMEOUT {
+			delete(s.inFlight, k)
+			delete(s.announced, k)
+		}
+	}
+
+	for k := range s.announced {
+		if _, ok := s.inFlight[k]; !ok {
+			delete(s.announced, k)
+		}
+	}
+}
+
+func newGetHeadersMessage(locator [][]byte) *Message {
+
+	m := NewMessage(MESSAGE_GET_HEADERS)
+	m.Data = MarshalHashes(locator)
+
+	return m
+}
+
+// Blocks that arrived before their parent. The pool is bounded by count and total size, and the
+// orphans of a single peer by MAX_ORPHAN_PEER_SIZE, oldest orphans go first when a limit is hit.
+type OrphanPool struct {
+	blocks   map[string]*orphan
+	children map[string][][]byte
+	order    [][]byte
+	size     int
+	peers    map[string]int
+}
+
+type orphan struct {
+	Block
+	// Peer that sent the block, empty for our own
+	peer string
+	size int
+}
+
+func NewOrphanPool() *OrphanPool {
+
+	return &OrphanPool{blocks: map[string]*orphan{}, children: map[string][][]byte{}, peers: map[string]int{}}
+}
+
+func (p *OrphanPool) Has(hash []byte) bool {
+
+	_, ok := p.blocks[string(hash)]
+	return ok
+}
+
+func (p *OrphanPool) Len() int {
+
+	return len(p.blocks)
+}
+
+// Total encoded size of the orphans
+func (p *OrphanPool) Size() int {
+
+	return p.size
+}
+
+func (p *OrphanPool) Add(b Block, peer string) {
+
+	hash := b.Hash()
+	if p.Has(hash) {
+		return
+	}
+	o := &orphan{b, peer, b.Size()}
+
+	// The peer makes room among its own orphans first, then the oldest ones go
+	for p.peers[peer] > 0 && p.peers[peer]+o.size > MAX_ORPHAN_PEER_SIZE {
+		p.remove(p.oldestOf(peer))
+	}
+	for (len(p.blocks) >= MAX_ORPHAN_BLOCKS || p.size+o.size > MAX_ORPHAN_POOL_SIZE) && len(p.order) > 0 {
+		p.remove(p.order[0])
+	}
+
+	p.blocks[string(hash)] = o
+	p.children[string(b.PrevBlock)] = append(p.children[string(b.PrevBlock)], hash)
+	p.order = append(p.order, hash)
+	p.size += o.size
+	p.peers[peer] += o.size
+}
+
+// Removes and returns the orphans whose parent is the given block
+func (p *OrphanPool) TakeChildren(parent []byte) BlockSlice {
+
+	bs := BlockSlice{}
+	for _, h := range p.children[string(parent)] {
+		if o, ok := p.blocks[string(h)]; ok {
+			bs = append(bs, o.Block)
+			p.remove(h)
+		}
+	}
+	delete(p.children, string(parent))
+
+	return bs
+}
+
+// Drops the orphans that descend from parent, which can't connect anymore
+func (p *OrphanPool) DropDescendants(parent []byte) {
+
+	queue := p.TakeChildren(parent)
+	for len(queue) > 0 {
+		queue = append(queue[1:], p.TakeChildren(queue[0].Hash())...)
+	}
+}
+
+func (p *OrphanPool) oldestOf(peer string) []byte {
+
+	for _, h := range p.order {
+		if p.blocks[string(h)].peer == peer {
+			return h
+		}
+	}
+
+	return nil
+}
+
+func (p *OrphanPool) remove(hash []byte) {
+
+	o, ok := p.blocks[string(hash)]
+	if !ok {
+		return
+	}
+	delete(p.blocks, string(hash))
+
+	p.size -= o.size
+	if p.peers[o.peer] -= o.size; p.peers[o.peer] <= 0 {
+		delete(p.peers, o.peer)
+	}
+
+	siblings := p.children[string(o.PrevBlock)]
+	for i, h := range siblings {
+		if bytes.Equal(h, hash) {
+			siblings = append(siblings[:i:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(p.children, string(o.PrevBlock))
+	} else {
+		p.children[string(o.PrevBlock)] = siblings
+	}
+
+	for i, h := range p.order {
+		if bytes.Equal(h, hash) {
+			p.order = append(p.order[:i:i], p.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Hash lists (locators and block requests) are encoded as a count followed by 32 byte hashes
+func MarshalHashes(hashes [][]byte) []byte {
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(len(hashes)))
+	for _, h := range hashes {
+		buf.Write(helpers.FitBytesInto(h, 32))
+	}
+
+	return buf.Bytes()
+}
+
+func UnmarshalHashes(d []byte) ([][]byte, error) {
+
+	if len(d) < 4 {
+		return nil, ErrEncodingTruncated
+	}
+
+	var count uint32
+	binary.Read(bytes.NewBuffer(d[:4]), binary.LittleEndian, &count)
+	d = d[4:]
+
+	if uint64(count)*32 != uint64(len(d)) {
+		return nil, ErrEncodingOverrun
+	}
+
+	hashes := make([][]byte, count)
+	for i := range hashes {
+		hashes[i] = d[i*32 : (i+1)*32]
+	}
+
+	return hashes, nil
+}
+
+// Header lists are encoded as a count followed by every header with its signature
+func MarshalHeaders(bs BlockSlice) []byte {
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(len(bs)))
+	for _, b := range bs {
+		hb, _ := b.BlockHeader.MarshalBinary()
+		buf.Write(hb)
+		buf.Write(helpers.FitBytesInto(b.Signature, NETWORK_KEY_SIZE))
+	}
+
+	return buf.Bytes()
+}
+
+func UnmarshalHeaders(d []byte) (BlockSlice, error) {
+
+	if len(d) < 4 {
+		return nil, ErrEncodingTruncated
+	}
+
+	var count uint32
+	binary.Read(bytes.NewBuffer(d[:4]), binary.LittleEndian, &count)
+	buf := bytes.NewBuffer(d[4:])
+
+	if uint64(count)*(BLOCK_HEADER_SIZE+NETWORK_KEY_SIZE) != uint64(buf.Len()) {
+		return nil, ErrEncodingOverrun
+	}
+
+	bs := make(BlockSlice, count)
+	for i := range bs {
+
+		header := new(BlockHeader)
+		if err := header.UnmarshalBinary(buf.Next(BLOCK_HEADER_SIZE)); err != nil {
+			return nil, err
+		}
+		bs[i] = Block{header, helpers.StripByte(buf.Next(NETWORK_KEY_SIZE), 0), new(TransactionSlice)}
+	}
+
+	return bs, nil
+}
@@ -0,0 +1,202 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/izqui/helpers"
+)
+
+func TestHashesMarshalling(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	b1 := newTestBlock(kp, nil)
+	b2 := newTestBlock(kp, &b1)
+	hashes := [][]byte{b1.Hash(), b2.Hash()}
+
+	newHashes, err := UnmarshalHashes(MarshalHashes(hashes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(newHashes, hashes) {
+		t.Error("Marshall, unmarshall hashes failed")
+	}
+
+	if _, err := UnmarshalHashes(MarshalHashes(hashes)[:40]); err == nil {
+		t.Error("Truncated hash list not rejected")
+	}
+}
+
+func TestHeadersAfterLocator(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	bl := newTestNode(kp).Blockchain
+	var prev *Block
+	for i := 0; i < 30; i++ {
+		b := newTestBlock(kp, prev, newTestTransaction(kp))
+		b.Bits = NextBlockBits(bl.Tree.Get(b.PrevBlock), bl.node.options.Consensus)
+		b.Signature = b.Sign(kp)
+		bl.AddBlock(b)
+		prev = &b
+	}
+
+	locator := bl.Locator()
+	if !reflect.DeepEqual(locator[0], bl.PreviousBlock().Hash()) || len(locator) >= 30 {
+		t.Error("Locator should start at the tip and skip blocks", len(locator))
+	}
+
+	// A peer that has the first 10 blocks
+	headers := bl.HeadersAfter([][]byte{bl.BlockSlice[9].Hash(), bl.BlockSlice[0].Hash()}, MAX_HEADERS_PER_MESSAGE)
+	if len(headers) != 20 || !reflect.DeepEqual(headers[0].Hash(), bl.BlockSlice[10].Hash()) {
+		t.Fatal("Wrong headers after locator", len(headers))
+	}
+
+	decoded, err := UnmarshalHeaders(MarshalHeaders(headers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range decoded {
+		if !SignatureVerify(decoded[i].Origin, decoded[i].Signature, decoded[i].Hash()) || !reflect.DeepEqual(decoded[i].Hash(), headers[i].Hash()) {
+			t.Error("Header", i, "changed when marshalling")
+		}
+	}
+
+	// A fresh node gets everything from genesis
+	if len(bl.HeadersAfter(nil, 5)) != 5 {
+		t.Error("Headers not capped to max")
+	}
+}
+
+func TestOrphanBlocksConnect(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	bl := newTestNode(kp).Blockchain
+
+	b0 := newTestBlock(kp, nil, newTestTransaction(kp))
+	b1 := newTestBlock(kp, &b0, newTestTransaction(kp))
+	b2 := newTestBlock(kp, &b1, newTestTransaction(kp))
+
+	for _, b := range []Block{b2, b1} {
+		if _, err := bl.ProcessBlock(b, ""); err != ErrOrphanBlock {
+			t.Fatal("Expected orphan", err)
+		}
+	}
+
+	if !bl.HasBlock(b2.Hash()) || bl.Orphans.Len() != 2 {
+		t.Fatal("Orphans not kept")
+	}
+
+	changed, err := bl.ProcessBlock(b0, "")
+	if err != nil || !changed {
+		t.Fatal("Processing parent failed", err)
+	}
+
+	if len(bl.BlockSlice) != 3 || bl.Orphans.Len() != 0 || !reflect.DeepEqual(bl.PreviousBlock().Hash(), b2.Hash()) {
+		t.Error("Orphans did not connect once their parent arrived")
+	}
+}
+
+func TestBadOrphanSibling(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	bl := newTestNode(kp).Blockchain
+
+	b0 := newTestBlock(kp, nil)
+	bad := newTestBlock(kp, &b0, newTestTransaction(kp))
+	bad.Bits = 0x1e00ffff
+	bad.Signature = bad.Sign(kp)
+	badChild := newTestBlock(kp, &bad)
+	good := newTestBlock(kp, &b0, newTestTransaction(kp))
+	goodChild := newTestBlock(kp, &good)
+
+	// The bad orphan is taken first and can't hide its sibling
+	for _, b := range []Block{bad, badChild, good, goodChild} {
+		if _, err := bl.ProcessBlock(b, "attacker"); err != ErrOrphanBlock {
+			t.Fatal("Expected orphan", err)
+		}
+	}
+
+	if _, err := bl.ProcessBlock(b0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bl.PreviousBlock().Hash(), goodChild.Hash()) {
+		t.Error("Good orphans dropped along with their bad sibling")
+	}
+	if bl.HasBlock(bad.Hash()) || bl.HasBlock(badChild.Hash()) || bl.Orphans.Len() != 0 {
+		t.Error("Bad orphan or its descendants kept")
+	}
+}
+
+func TestOrphanPoolLimits(t *testing.T) {
+
+	p := NewOrphanPool()
+	orphan := func(size int) Block {
+		b := NewBlock([]byte(helpers.RandomString(32)))
+		b.AddTransaction(NewTransaction(nil, nil, make([]byte, size)))
+		return b
+	}
+
+	// A peer only pushes out its own orphans
+	mine := orphan(1024)
+	p.Add(mine, "")
+	first := orphan(MAX_ORPHAN_PEER_SIZE / 3)
+	p.Add(first, "a")
+	for i := 0; i < 4; i++ {
+		p.Add(orphan(MAX_ORPHAN_PEER_SIZE/3), "a")
+	}
+	if p.Has(first.Hash()) || !p.Has(mine.Hash()) || p.Len() != 3 || p.peers["a"] > MAX_ORPHAN_PEER_SIZE {
+		t.Error("Peer orphans not capped", p.Len(), p.peers["a"])
+	}
+
+	for _, peer := range []string{"b", "c", "d", "e", "f"} {
+		for i := 0; i < 3; i++ {
+			p.Add(orphan(MAX_ORPHAN_PEER_SIZE/3), peer)
+		}
+	}
+	if p.Size() > MAX_ORPHAN_POOL_SIZE || p.Has(mine.Hash()) {
+		t.Error("Pool size not capped", p.Size())
+	}
+
+	child := orphan(1024)
+	p.Add(child, "g")
+	size := p.Size()
+	if bs := p.TakeChildren(child.PrevBlock); len(bs) != 1 || p.Size() != size-child.Size() || p.peers["g"] != 0 {
+		t.Error("Taken orphan still counted", p.Size(), size)
+	}
+}
+
+// Light nodes add headers from the message handlers while the run loop adds blocks, run with -race
+func TestLightHeadersConcurrentWithBlocks(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	light, err := NewNode(NodeOptions{Keypair: GenerateNewKeypair(), Light: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := BlockSlice{}
+	var parent *Block
+	for i := 0; i < 10; i++ {
+		b := newTestBlock(kp, parent)
+		b.Nonce = b.GenerateNonce()
+		b.Signature = b.Sign(kp)
+		headers = append(headers, Block{b.BlockHeader, b.Signature, new(TransactionSlice)})
+		parent = &b
+	}
+
+	start, done := make(chan bool), make(chan bool)
+	go func() {
+		<-start
+		light.Syncer.connectHeaders("peer", headers)
+		done <- true
+	}()
+	close(start)
+	for _, h := range headers {
+		light.Blockchain.ProcessBlock(h, "")
+	}
+	<-done
+
+	if len(light.Blockchain.BlockSlice) != len(headers) {
+		t.Error("Headers not connected", len(light.Blockchain.BlockSlice))
+	}
+}
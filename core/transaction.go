@@ -10,6 +10,14 @@ import (
 	"github.com/izqui/helpers"
 )
 
+var (
+	ErrPayloadTooLarge         = errors.New("Transaction payload is over the size limit")
+	ErrBadPayloadHash          = errors.New("Transaction payload doesn't match its hash")
+	ErrBadTransactionPow       = errors.New("Transaction hash doesn't have the proof of work")
+	ErrBadTransactionSignature = errors.New("Transaction signature is invalid")
+	ErrFeeWithoutLedger        = errors.New("Transaction pays a fee without the ledger to take it from")
+)
+
 type Transaction struct {
 	Header    TransactionHeader
 	Signature []byte
@@ -17,8 +25,14 @@ type Transaction struct {
 }
 
 type TransactionHeader struct {
-	From          []byte
-	To            []byte
+	From []byte
+	To   []byte
+	// Value moved from From to To and number of transactions sent by From, checked when the
+	// chain keeps a ledger
+	Amount   uint64
+	Sequence uint64
+	// Paid to the miner in the coinbase, transactions with a higher fee per byte go first
+	Fee           uint64
 	Timestamp     uint32
 	PayloadHash   []byte
 	PayloadLength uint32
@@ -50,12 +64,30 @@ func (t *Transaction) Sign(keypair *Keypair) []byte {
 	return s
 }
 
-func (t *Transaction) VerifyTransaction(pow []byte) bool {
+func (t *Transaction) VerifyTransaction(pow []byte, params ConsensusParams) error {
+
+	if len(t.Payload) > params.MaxPayloadSize {
+		return ErrPayloadTooLarge
+	}
+	// Without balances nothing backs a fee, it would only buy priority for free
+	if t.Header.Fee > 0 && !params.Ledger {
+		return ErrFeeWithoutLedger
+	}
 
 	headerHash := t.Hash()
 	payloadHash := helpers.SHA256(t.Payload)
 
-	return reflect.DeepEqual(payloadHash, t.Header.PayloadHash) && CheckProofOfWork(pow, headerHash) && SignatureVerify(t.Header.From, t.Signature, headerHash)
+	if !reflect.DeepEqual(payloadHash, t.Header.PayloadHash) {
+		return ErrBadPayloadHash
+	}
+	if !CheckProofOfWork(pow, headerHash) {
+		return ErrBadTransactionPow
+	}
+	if !SignatureVerify(t.Header.From, t.Signature, headerHash) {
+		return ErrBadTransactionSignature
+	}
+
+	return nil
 }
 
 func (t *Transaction) GenerateNonce(prefix []byte) uint32 {
@@ -73,6 +105,19 @@ func (t *Transaction) GenerateNonce(prefix []byte) uint32 {
 	return newT.Header.Nonce
 }
 
+// Encoded size in bytes
+func (t *Transaction) Size() int {
+
+	data, _ := t.MarshalBinary()
+	return len(data)
+}
+
+// Fee paid per encoded byte
+func (t *Transaction) FeeRate() float64 {
+
+	return float64(t.Header.Fee) / float64(t.Size())
+}
+
 func (t *Transaction) MarshalBinary() ([]byte, error) {
 
 	headerBytes, _ := t.Header.MarshalBinary()
@@ -89,7 +134,7 @@ func (t *Transaction) UnmarshalBinary(d []byte) ([]byte, error) {
 	buf := bytes.NewBuffer(d)
 
 	if len(d) < TRANSACTION_HEADER_SIZE+NETWORK_KEY_SIZE {
-		return nil, errors.New("Insuficient bytes for unmarshalling transaction")
+		return nil, ErrEncodingTruncated
 	}
 
 	header := &TransactionHeader{}
@@ -100,6 +145,10 @@ func (t *Transaction) UnmarshalBinary(d []byte) ([]byte, error) {
 	t.Header = *header
 
 	t.Signature = helpers.StripByte(buf.Next(NETWORK_KEY_SIZE), 0)
+
+	if uint64(t.Header.PayloadLength) > uint64(buf.Len()) {
+		return nil, ErrEncodingTruncated
+	}
 	t.Payload = buf.Next(int(t.Header.PayloadLength))
 
 	return buf.Next(helpers.MaxInt), nil
@@ -112,6 +161,9 @@ func (th *TransactionHeader) MarshalBinary() ([]byte, error) {
 
 	buf.Write(helpers.FitBytesInto(th.From, NETWORK_KEY_SIZE))
 	buf.Write(helpers.FitBytesInto(th.To, NETWORK_KEY_SIZE))
+	binary.Write(buf, binary.LittleEndian, th.Amount)
+	binary.Write(buf, binary.LittleEndian, th.Sequence)
+	binary.Write(buf, binary.LittleEndian, th.Fee)
 	binary.Write(buf, binary.LittleEndian, th.Timestamp)
 	buf.Write(helpers.FitBytesInto(th.PayloadHash, 32))
 	binary.Write(buf, binary.LittleEndian, th.PayloadLength)
@@ -126,6 +178,9 @@ func (th *TransactionHeader) UnmarshalBinary(d []byte) error {
 	buf := bytes.NewBuffer(d)
 	th.From = helpers.StripByte(buf.Next(NETWORK_KEY_SIZE), 0)
 	th.To = helpers.StripByte(buf.Next(NETWORK_KEY_SIZE), 0)
+	binary.Read(bytes.NewBuffer(buf.Next(8)), binary.LittleEndian, &th.Amount)
+	binary.Read(bytes.NewBuffer(buf.Next(8)), binary.LittleEndian, &th.Sequence)
+	binary.Read(bytes.NewBuffer(buf.Next(8)), binary.LittleEndian, &th.Fee)
 	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &th.Timestamp)
 	th.PayloadHash = buf.Next(32)
 	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &th.PayloadLength)
@@ -163,9 +218,13 @@ func (slice TransactionSlice) AddTransaction(t Transaction) TransactionSlice {
 	return append(slice, t)
 }
 
+// Encoded as a transaction count followed by every transaction prefixed with its length:
+//
+//	count (4 bytes) | length (4 bytes) | transaction | length (4 bytes) | transaction ...
 func (slice *TransactionSlice) MarshalBinary() ([]byte, error) {
 
 	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(len(*slice)))
 
 	for _, t := range *slice {
 
@@ -175,6 +234,7 @@ func (slice *TransactionSlice) MarshalBinary() ([]byte, error) {
 			return nil, err
 		}
 
+		binary.Write(buf, binary.LittleEndian, uint32(len(bs)))
 		buf.Write(bs)
 	}
 
@@ -183,17 +243,73 @@ func (slice *TransactionSlice) MarshalBinary() ([]byte, error) {
 
 func (slice *TransactionSlice) UnmarshalBinary(d []byte) error {
 
-	remaining := d
+	err := scanTransactionSlice(d, func(record []byte) error {
 
-	for len(remaining) > TRANSACTION_HEADER_SIZE+NETWORK_KEY_SIZE {
 		t := new(Transaction)
-		rem, err := t.UnmarshalBinary(remaining)
-
-		if err != nil {
+		if _, err := t.UnmarshalBinary(record); err != nil {
 			return err
 		}
 		(*slice) = append((*slice), *t)
-		remaining = rem
+
+		return nil
+	})
+
+	return err
+}
+
+// Walks the length prefixes of an encoded transaction slice calling f with every transaction record.
+// Each record is checked to be exactly as long as its header says, without decoding the payload.
+func scanTransactionSlice(d []byte, f func(record []byte) error) error {
+
+	if len(d) < 4 {
+		return ErrEncodingTruncated
+	}
+
+	var count uint32
+	binary.Read(bytes.NewBuffer(d[:4]), binary.LittleEndian, &count)
+	remaining := d[4:]
+
+	// Every transaction takes at least a length prefix, a header and a signature
+	if uint64(count)*(4+TRANSACTION_HEADER_SIZE+NETWORK_KEY_SIZE) > uint64(len(remaining)) {
+		return ErrEncodingTruncated
+	}
+
+	for i := uint32(0); i < count; i++ {
+
+		if len(remaining) < 4 {
+			return ErrEncodingTruncated
+		}
+
+		var length uint32
+		binary.Read(bytes.NewBuffer(remaining[:4]), binary.LittleEndian, &length)
+		remaining = remaining[4:]
+
+		if uint64(length) > uint64(len(remaining)) {
+			return ErrEncodingTruncated
+		}
+		if length < TRANSACTION_HEADER_SIZE+NETWORK_KEY_SIZE {
+			return ErrEncodingOverrun
+		}
+
+		record := remaining[:length]
+		remaining = remaining[length:]
+
+		var payloadLength uint32
+		binary.Read(bytes.NewBuffer(record[TRANSACTION_PAYLOAD_LENGTH_OFFSET:TRANSACTION_PAYLOAD_LENGTH_OFFSET+4]), binary.LittleEndian, &payloadLength)
+		if uint64(payloadLength) != uint64(length)-(TRANSACTION_HEADER_SIZE+NETWORK_KEY_SIZE) {
+			return ErrEncodingOverrun
+		}
+
+		if f != nil {
+			if err := f(record); err != nil {
+				return err
+			}
+		}
 	}
+
+	if len(remaining) > 0 {
+		return ErrEncodingOverrun
+	}
+
 	return nil
 }
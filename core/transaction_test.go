@@ -42,7 +42,7 @@ func TestTransactionVerification(t *testing.T) {
 	tr.Header.Nonce = tr.GenerateNonce(pow)
 	tr.Signature = tr.Sign(kp)
 
-	if !tr.VerifyTransaction(pow) {
+	if err := tr.VerifyTransaction(pow, DefaultConsensusParams()); err != nil {
 
 		t.Error("Validation failing")
 	}
@@ -58,7 +58,7 @@ func TestIncorrectTransactionPOWVerification(t *testing.T) {
 	tr.Header.Nonce = tr.GenerateNonce(powIncorrect)
 	tr.Signature = tr.Sign(kp)
 
-	if tr.VerifyTransaction(pow) {
+	if tr.VerifyTransaction(pow, DefaultConsensusParams()) != ErrBadTransactionPow {
 
 		t.Error("Passed validation without pow")
 	}
@@ -72,8 +72,22 @@ func TestIncorrectTransactionSignatureVerification(t *testing.T) {
 	tr.Header.Nonce = tr.GenerateNonce(pow)
 	tr.Signature = tr.Sign(kp1)
 
-	if tr.VerifyTransaction(pow) {
+	if tr.VerifyTransaction(pow, DefaultConsensusParams()) != ErrBadTransactionSignature {
 
 		t.Error("Passed validation with incorrect key")
 	}
 }
+
+func TestTransactionPayloadLengthBounds(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	tr := NewTransaction(kp.Public, nil, []byte(helpers.RandomString(helpers.RandomInt(1, 1024))))
+	tr.Signature = tr.Sign(kp)
+
+	tr.Header.PayloadLength += 1
+	data, _ := tr.MarshalBinary()
+
+	if _, err := new(Transaction).UnmarshalBinary(data); err != ErrEncodingTruncated {
+		t.Error("Payload length past the end of data not rejected", err)
+	}
+}
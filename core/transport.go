@@ -0,0 +1,157 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/izqui/helpers"
+)
+
+var (
+	ErrNoTransportKey    = errors.New("Peer certificate isn't bound to a node key")
+	ErrBadTransportKey   = errors.New("Peer certificate signature by its node key is invalid")
+	ErrPeerKeyMismatch   = errors.New("Peer handshake key isn't the one of its connection")
+	ErrUnexpectedPeerKey = errors.New("Peer node key isn't the one configured for its address")
+)
+
+// Certificate extension with the node public key and its signature of the certificate key
+var transportKeyExtension = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+
+type transportKey struct {
+	PublicKey []byte
+	Signature []byte
+}
+
+// Encrypted transport, used when NodeOptions.EncryptTransport is set. Connections are TLS 1.3 and
+// both ends present a self-signed certificate for a throwaway key. The certificate carries the
+// node public key and its signature of the certificate key, so the peer at the other end is known
+// to hold the private key of the node it claims to be and the handshake has to announce that key.
+//
+// Plain and encrypted nodes can't talk to each other.
+func newTransportConfig(kp *Keypair) (*tls.Config, error) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	spki, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := kp.Sign(transportKeyHash(spki))
+	if err != nil {
+		return nil, err
+	}
+	ext, err := asn1.Marshal(transportKey{kp.Public, sig})
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:    serial,
+		Subject:         pkix.Name{CommonName: string(kp.Public)},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(TRANSPORT_CERTIFICATE_VALIDITY),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		ExtraExtensions: []pkix.Extension{{Id: transportKeyExtension, Value: ext}},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS13,
+		ClientAuth:   tls.RequireAnyClientCert,
+		// There are no certificate authorities, the certificate is checked against the node key it carries
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(certs [][]byte, _ [][]*x509.Certificate) error {
+			if len(certs) == 0 {
+				return ErrNoTransportKey
+			}
+			_, err := certificateNodeKey(certs[0])
+			return err
+		},
+	}, nil
+}
+
+// The node key signs a hash of the certificate key tagged for this use only
+func transportKeyHash(spki []byte) []byte {
+
+	return helpers.SHA256(append([]byte(TRANSPORT_KEY_TAG), spki...))
+}
+
+// Node public key a certificate is bound to
+func certificateNodeKey(der []byte) ([]byte, error) {
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range cert.Extensions {
+
+		if !e.Id.Equal(transportKeyExtension) {
+			continue
+		}
+
+		var k transportKey
+		if rest, err := asn1.Unmarshal(e.Value, &k); err != nil || len(rest) > 0 {
+			return nil, ErrNoTransportKey
+		}
+		if !ValidPublicKey(k.PublicKey) || !SignatureVerify(k.PublicKey, k.Signature, transportKeyHash(cert.RawSubjectPublicKeyInfo)) {
+			return nil, ErrBadTransportKey
+		}
+
+		return k.PublicKey, nil
+	}
+
+	return nil, ErrNoTransportKey
+}
+
+// Wraps a new connection with the encrypted transport, when enabled. The TLS handshake happens
+// with the first read or write, under the deadlines of the version handshake.
+func (n *Network) wrapConnection(con net.Conn, inbound bool) net.Conn {
+
+	if n.transport == nil {
+		return con
+	}
+	if inbound {
+		return tls.Server(con, n.transport)
+	}
+
+	return tls.Client(con, n.transport)
+}
+
+// Node key the connection is authenticated with, nil for plain connections
+func transportPeerKey(con net.Conn) []byte {
+
+	t, ok := con.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	certs := t.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	key, _ := certificateNodeKey(certs[0].Raw)
+
+	return key
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTransportCertificate(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	config, err := newTransportConfig(kp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := certificateNodeKey(config.Certificates[0].Certificate[0])
+	if err != nil || !reflect.DeepEqual(key, kp.Public) {
+		t.Error("Certificate not bound to the node key", err)
+	}
+
+	// Claims the key of kp without its private key
+	impostor := &Keypair{Public: kp.Public, Private: GenerateNewKeypair().Private}
+	config, err = newTransportConfig(impostor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := certificateNodeKey(config.Certificates[0].Certificate[0]); err != ErrBadTransportKey {
+		t.Error("Certificate signed by another key accepted", err)
+	}
+}
+
+func TestEncryptedTransport(t *testing.T) {
+
+	a, _ := NewNode(NodeOptions{Keypair: GenerateNewKeypair(), Address: freeLocalAddress(), EncryptTransport: true})
+	b, _ := NewNode(NodeOptions{Keypair: GenerateNewKeypair(), Address: freeLocalAddress(), EncryptTransport: true})
+	plain, _ := NewNode(NodeOptions{Keypair: GenerateNewKeypair(), Address: freeLocalAddress()})
+	for _, n := range []*Node{a, b, plain} {
+		if err := n.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		defer n.Stop()
+	}
+
+	b.Network.ConnectToPeer(context.Background(), a.Network.Address, time.Second, false, b.Network.ConnectionCallback)
+	plain.Network.ConnectToPeer(context.Background(), a.Network.Address, time.Second, false, plain.Network.ConnectionCallback)
+	for i := 0; i < 100 && a.Network.PeerCount() == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if a.Network.PeerCount() != 1 || plain.Network.PeerCount() != 0 {
+		t.Fatal("Only the encrypted node should connect", a.Network.PeerCount(), plain.Network.PeerCount())
+	}
+
+	p := a.Network.Peer(a.Network.PeerAddresses()[0])
+	con, ok := p.Conn.(*tls.Conn)
+	if !ok || con.ConnectionState().Version != tls.VersionTLS13 {
+		t.Fatal("Connection not encrypted")
+	}
+	if !reflect.DeepEqual(transportPeerKey(con), b.Keypair.Public) || !reflect.DeepEqual(p.Version.PublicKey, b.Keypair.Public) {
+		t.Error("Peer not authenticated with its node key")
+	}
+
+	// A valid certificate of one key can't be used to announce another
+	config, _ := newTransportConfig(GenerateNewKeypair())
+	raw, err := net.Dial("tcp4", a.Network.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostor := tls.Client(raw, config)
+	defer impostor.Close()
+
+	v := PeerVersion{Protocol: PROTOCOL_VERSION, Magic: MESSAGE_MAGIC, PublicKey: b.Keypair.Public}
+	m := NewMessage(MESSAGE_VERSION)
+	m.Data, _ = v.MarshalBinary()
+	NewMessageWriter(impostor, MaxFrameSize(DefaultConsensusParams())).WriteMessage(m)
+
+	impostor.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := NewMessageReader(impostor, MaxFrameSize(DefaultConsensusParams()))
+	for {
+		m, err := r.ReadMessage()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Error("Impostor not disconnected")
+			}
+			break
+		}
+		if m.Identifier == MESSAGE_VERACK {
+			t.Error("Impostor version acknowledged")
+		}
+	}
+}
+
+func TestPinnedPeerKey(t *testing.T) {
+
+	a, _ := NewNode(NodeOptions{Keypair: GenerateNewKeypair(), Address: freeLocalAddress(), EncryptTransport: true})
+	if err := a.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+
+	if _, err := NewNode(NodeOptions{Keypair: GenerateNewKeypair(), PersistentPeers: []string{a.Network.Address + "@nokey"}}); err != ErrInvalidPeerKey {
+		t.Error("Invalid peer key accepted", err)
+	}
+
+	wrong, _ := NewNode(NodeOptions{Keypair: GenerateNewKeypair(), Address: freeLocalAddress(), EncryptTransport: true,
+		PersistentPeers: []string{a.Network.Address + "@" + string(GenerateNewKeypair().Public)}})
+	right, _ := NewNode(NodeOptions{Keypair: GenerateNewKeypair(), Address: freeLocalAddress(), EncryptTransport: true,
+		PersistentPeers: []string{a.Network.Address + "@" + string(a.Keypair.Public)}})
+	for _, n := range []*Node{wrong, right} {
+		if err := n.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		defer n.Stop()
+	}
+
+	for i := 0; i < 100 && right.Network.PeerCount() == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if right.Network.PeerCount() != 1 {
+		t.Error("Peer with the configured key not connected")
+	}
+	if wrong.Network.PeerCount() != 0 {
+		t.Error("Peer with another key connected")
+	}
+}
@@ -0,0 +1,197 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/izqui/helpers"
+)
+
+// Hashes of encoded transactions whose payload, proof of work and signature were already checked, so
+// a block doesn't verify again the transactions that went through our mempool. Oldest hashes go first
+// when full.
+type VerifiedCache struct {
+	max    int
+	hashes map[string]bool
+	order  [][]byte
+
+	lock sync.Mutex
+}
+
+func NewVerifiedCache(max int) *VerifiedCache {
+
+	return &VerifiedCache{max: max, hashes: map[string]bool{}}
+}
+
+func (c *VerifiedCache) Has(hash []byte) bool {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.hashes[string(hash)]
+}
+
+func (c *VerifiedCache) Add(hash []byte) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.hashes[string(hash)] {
+		return
+	}
+
+	for len(c.hashes) >= c.max && len(c.order) > 0 {
+		delete(c.hashes, string(c.order[0]))
+		c.order = c.order[1:]
+	}
+
+	c.hashes[string(hash)] = true
+	c.order = append(c.order, hash)
+}
+
+func (c *VerifiedCache) Len() int {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.hashes)
+}
+
+// Key of a transaction in the cache. Transaction.Hash only covers the header, the key covers the
+// signature and payload too so a known header can't bring along a different one.
+func verifiedKey(t *Transaction) []byte {
+
+	data, _ := t.MarshalBinary()
+	return helpers.SHA256(data)
+}
+
+// Checks a transaction once, later calls with the same transaction hit the cache
+func (bl *Blockchain) VerifyTransaction(t *Transaction) error {
+
+	hash := verifiedKey(t)
+	if bl.Verified.Has(hash) {
+		return nil
+	}
+
+	if err := t.VerifyTransaction(bl.node.options.TransactionPow, bl.node.options.Consensus); err != nil {
+		return err
+	}
+	bl.Verified.Add(hash)
+
+	return nil
+}
+
+// Verifies the transactions of a block in a pool of at most NodeOptions.VerifyWorkers goroutines,
+// skipping the coinbase and the cached ones. Returns the first error found.
+func (bl *Blockchain) VerifyTransactions(ts TransactionSlice) error {
+
+	workers := bl.node.options.VerifyWorkers
+	if workers > len(ts) {
+		workers = len(ts)
+	}
+
+	jobs := make(chan *Transaction)
+	errs := make(chan error, 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for t := range jobs {
+				if err := bl.VerifyTransaction(t); err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for i := range ts {
+
+		if ts[i].IsCoinbase() {
+			continue
+		}
+
+		select {
+		case jobs <- &ts[i]:
+		case err = <-errs:
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+
+	return err
+}
+
+// Checks a block in stages, cheapest first, so invalid blocks are dropped before the expensive work:
+// the header, then the body against the consensus limits and the rules of its height, then the
+// transaction signatures.
+func (bl *Blockchain) ValidateBlock(b Block) error {
+
+	if err := b.VerifyBlock(bl.node.options.Consensus); err != nil {
+		return err
+	}
+
+	// Orphans get these checks once their parent arrives
+	bl.lock.RLock()
+	parent := bl.Tree.Get(b.PrevBlock)
+	bl.lock.RUnlock()
+	if parent != nil || b.IsGenesis() {
+		if err := b.VerifyContext(parent, bl.node.options.Consensus, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	return bl.VerifyTransactions(*b.TransactionSlice)
+}
+
+// Validates the blocks coming from the queue outside of the run loop, which only gets the valid ones
+func (bl *Blockchain) validateBlocks(ctx context.Context) <-chan QueuedBlock {
+
+	valid := make(chan QueuedBlock)
+
+	bl.node.spawn(func() {
+		for {
+			select {
+			case b := <-bl.BlocksQueue:
+
+				if bl.HasBlock(b.Hash()) {
+					continue
+				}
+
+				if err := bl.ValidateBlock(b.Block); err != nil {
+					fmt.Println("block verification fails:", err)
+					continue
+				}
+
+				select {
+				case valid <- b:
+				case <-ctx.Done():
+					return
+				}
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+
+	return valid
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestVerifiedCache(t *testing.T) {
+
+	c := NewVerifiedCache(2)
+	c.Add([]byte("a"))
+	c.Add([]byte("b"))
+	c.Add([]byte("a"))
+	c.Add([]byte("c"))
+
+	if c.Len() != 2 || c.Has([]byte("a")) || !c.Has([]byte("b")) || !c.Has([]byte("c")) {
+		t.Error("Cache doesn't evict the oldest hash", c.Len())
+	}
+}
+
+func TestValidateBlock(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	node, err := NewNode(NodeOptions{Keypair: kp, VerifyWorkers: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := node.Blockchain
+
+	trs := []*Transaction{}
+	for _, payload := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		trs = append(trs, newTestTransaction(kp, withPayload(payload), withPow()))
+	}
+
+	// Verified at mempool intake, the block doesn't check it again
+	if err := bl.VerifyTransaction(trs[0]); err != nil || bl.Verified.Len() != 1 {
+		t.Fatal("Transaction not verified once", err)
+	}
+
+	b := newTestBlock(kp, nil, trs...)
+	b.Nonce = b.GenerateNonce()
+	b.Signature = b.Sign(kp)
+	if err := bl.ValidateBlock(b); err != nil {
+		t.Fatal("Valid block fails validation", err)
+	}
+	if bl.Verified.Len() != len(trs) {
+		t.Error("Block transactions not cached", bl.Verified.Len())
+	}
+
+	forged := newTestTransaction(kp, withPayload("forged"), withPow())
+	forged.Signature = forged.Sign(GenerateNewKeypair())
+	b = newTestBlock(kp, nil, append(trs, forged)...)
+	b.Nonce = b.GenerateNonce()
+	b.Signature = b.Sign(kp)
+	if err := bl.ValidateBlock(b); err != ErrBadTransactionSignature {
+		t.Error("Block with a forged transaction passes", err)
+	}
+	if bl.Verified.Has(verifiedKey(forged)) {
+		t.Error("Forged transaction cached")
+	}
+
+	// A cached header doesn't vouch for another signature or payload
+	tampered := *trs[0]
+	tampered.Signature = trs[1].Signature
+	tampered.Payload = []byte("z")
+	b = newTestBlock(kp, nil, append(trs, &tampered)...)
+	b.Nonce = b.GenerateNonce()
+	b.Signature = b.Sign(kp)
+	if err := bl.ValidateBlock(b); err != ErrBadPayloadHash {
+		t.Error("Block with a tampered transaction passes", err)
+	}
+
+	tampered.Payload = trs[0].Payload
+	b = newTestBlock(kp, nil, append(trs, &tampered)...)
+	b.Nonce = b.GenerateNonce()
+	b.Signature = b.Sign(kp)
+	if err := bl.ValidateBlock(b); err != ErrBadTransactionSignature {
+		t.Error("Block with a tampered signature passes", err)
+	}
+
+	// The header is checked before anything else
+	b.Nonce++
+	for CheckProofOfWorkTarget(b.Bits, b.Hash()) {
+		b.Nonce++
+	}
+	if err := bl.ValidateBlock(b); err != ErrBadBlockPow {
+		t.Error("Block without proof of work not rejected first", err)
+	}
+}